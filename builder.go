@@ -2,20 +2,29 @@ package cbor
 
 import (
 	"bytes"
+	"encoding"
 	"encoding/binary"
 	"errors"
 	"math"
 	"math/big"
+	"net/netip"
 	"reflect"
+	"regexp"
 	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/x448/float16"
 )
 
 const (
-	cborFalse byte = 0xf4
-	cborTrue  byte = 0xf5
-	cborNil   byte = 0xf6
+	cborFalse     byte = 0xf4
+	cborTrue      byte = 0xf5
+	cborNil       byte = 0xf6
+	cborUndefined byte = 0xf7
+	cborBreak     byte = 0xff
 )
 
 var (
@@ -35,6 +44,17 @@ const (
 	// (float64 NaN stays float64, etc. even if it can use float16 without losing
 	// any bits).
 	ModeNaNNone
+
+	// ModeNaNReject sets an error when encoding NaN, as required by
+	// encodings that only allow finite floats.
+	ModeNaNReject
+
+	// ModeNaNPreservePayload encodes NaN in the shortest of float16, float32
+	// and float64 that holds its sign, quiet bit and payload exactly, so that
+	// signaling NaNs and the information carried in payloads are kept.
+	// A NaN is only narrowed if the low-order payload bits dropped by the
+	// narrower format are all zero, regardless of ModeFloat.
+	ModeNaNPreservePayload
 )
 
 // ModeInf specifies how to encode Infinity and overrides ModeFloat.
@@ -47,6 +67,10 @@ const (
 
 	// ModeInfNone never converts (used by CTAP2 Canonical CBOR).
 	ModeInfNone
+
+	// ModeInfReject sets an error when encoding Infinity, as required by
+	// encodings that only allow finite floats.
+	ModeInfReject
 )
 
 // ModeFloat specifies which floating-point format should
@@ -65,6 +89,11 @@ const (
 	// E.g. a float32 in Go will encode to CBOR float32.  And
 	// a float64 in Go will encode to CBOR float64.
 	ModeFloatNone
+
+	// ModeFloat32 specifies float32 as the shortest form that preserves value.
+	// A float64 might encode as CBOR float64 or float32, but never float16,
+	// for decoders that don't support it.
+	ModeFloat32
 )
 
 // ModeSort identifies supported sorting order.
@@ -86,6 +115,191 @@ const (
 
 	// ModeSortNone means no sorting.
 	ModeSortNone
+
+	// ModeSortNumeric causes integer map keys to be sorted by their numeric
+	// value, so that negative keys sort before positive ones, as some peers
+	// expect. Other keys, including bignums, sort as in ModeSortBytewiseLexical,
+	// which places them after all the integer keys.
+	ModeSortNumeric
+)
+
+// ModeEmptyString specifies how to encode empty text strings.
+type ModeEmptyString int
+
+const (
+	// ModeEmptyStringText encodes an empty string as an empty CBOR text string (0x60).
+	ModeEmptyStringText ModeEmptyString = iota
+
+	// ModeEmptyStringNull encodes an empty string as CBOR null (0xf6).
+	ModeEmptyStringNull
+)
+
+// ModeDenseIntMap specifies how AddDenseIntMap encodes maps
+// whose keys form the contiguous range 0..n-1.
+type ModeDenseIntMap int
+
+const (
+	// ModeDenseIntMapNone always encodes a CBOR map.
+	ModeDenseIntMapNone ModeDenseIntMap = iota
+
+	// ModeDenseIntMapArray encodes a CBOR array when the keys are dense,
+	// which saves one key per item. Sparse maps are still encoded as maps.
+	ModeDenseIntMapArray
+)
+
+// ModeTime specifies how to encode time.Time values.
+type ModeTime int
+
+const (
+	// ModeTimeRFC3339 encodes time as CBOR tag 0 with an RFC 3339 text string
+	// content, preserving nanosecond precision and the timezone offset.
+	ModeTimeRFC3339 ModeTime = iota
+
+	// ModeTimeUnix encodes time as CBOR tag 1 with a content holding
+	// the number of seconds elapsed since the Unix epoch. The content is
+	// an integer if the time has no sub-second component, else a float64.
+	ModeTimeUnix
+
+	// ModeTimeUnixFloat encodes time as CBOR tag 1 with a float64 content
+	// holding the number of seconds elapsed since the Unix epoch.
+	// A float64 has 53 bits of precision, so nanoseconds are only preserved
+	// for times close to the epoch; present-day times round to roughly
+	// a quarter of a microsecond.
+	ModeTimeUnixFloat
+)
+
+// ModeIndefinite specifies whether indefinite-length items can be encoded.
+type ModeIndefinite int
+
+const (
+	// ModeIndefiniteAllow allows encoding indefinite-length arrays, maps and strings.
+	ModeIndefiniteAllow ModeIndefinite = iota
+
+	// ModeIndefiniteForbid makes any attempt to encode an indefinite-length
+	// item set an error, as required by deterministic encodings.
+	ModeIndefiniteForbid
+)
+
+// ModeError specifies how to encode values implementing the error interface.
+type ModeError int
+
+const (
+	// ModeErrorNone encodes errors as any other value of their type.
+	ModeErrorNone ModeError = iota
+
+	// ModeErrorString encodes errors as a text string holding their message.
+	ModeErrorString
+
+	// ModeErrorStructured encodes errors as a map with the "type" and
+	// "message" keys, holding the Go type and the message of the error,
+	// and a "cause" key holding the error returned by errors.Unwrap encoded
+	// in the same way, if any. At most maxErrorCauses causes are encoded.
+	ModeErrorStructured
+)
+
+// maxErrorCauses bounds the length of the unwrap chain encoded
+// with ModeErrorStructured.
+const maxErrorCauses = 16
+
+// ModeByteSlice specifies how to encode byte slices and arrays.
+type ModeByteSlice int
+
+const (
+	// ModeByteSliceByteString encodes byte slices and arrays as byte strings.
+	ModeByteSliceByteString ModeByteSlice = iota
+
+	// ModeByteSliceArray encodes byte slices and arrays as arrays of
+	// unsigned integers, for schemas that forbid byte strings.
+	ModeByteSliceArray
+)
+
+// ModeComplexArray specifies how AddComplex128Array encodes complex numbers.
+type ModeComplexArray int
+
+const (
+	// ModeComplexArrayPairs encodes an array holding a [real, imag]
+	// array for each complex number, as any complex value is encoded.
+	ModeComplexArrayPairs ModeComplexArray = iota
+
+	// ModeComplexArrayInterleaved encodes a flat array of floats holding
+	// the real and imaginary parts of each complex number in turn,
+	// which saves one array head per element.
+	ModeComplexArrayInterleaved
+)
+
+// ModeUnsupported specifies how to encode values of the kinds that have
+// no CBOR representation: funcs, channels and unsafe pointers.
+type ModeUnsupported int
+
+const (
+	// ModeUnsupportedError makes encoding a func, channel or unsafe pointer
+	// set an error, even if it is nil.
+	ModeUnsupportedError ModeUnsupported = iota
+
+	// ModeUnsupportedNilNull encodes nil funcs, channels and unsafe pointers
+	// as null. Encoding a non-nil one still sets an error.
+	ModeUnsupportedNilNull
+
+	// ModeUnsupportedNilUndefined encodes nil funcs, channels and unsafe
+	// pointers as undefined, which tells them apart from nil pointers,
+	// slices and maps. Encoding a non-nil one still sets an error.
+	ModeUnsupportedNilUndefined
+)
+
+// ModeIntWidth specifies the width of the head of encoded integers.
+type ModeIntWidth int
+
+const (
+	// ModeIntWidthShortest encodes integers in the shortest possible head,
+	// as required by deterministic encodings.
+	ModeIntWidthShortest ModeIntWidth = iota
+
+	// ModeIntWidthFixed64 always encodes integers in a 9-byte head holding
+	// a 64-bit argument, so that fixed-layout protocols get fields of a
+	// predictable size. Lengths, tag numbers and simple values still use
+	// the shortest form, as do bignums.
+	ModeIntWidthFixed64
+)
+
+// ModeShare specifies how values referenced more than once are encoded.
+type ModeShare int
+
+const (
+	// ModeShareNone encodes a value each time it is referenced.
+	ModeShareNone ModeShare = iota
+
+	// ModeSharePointers encodes pointers that occur more than once in the
+	// value passed to Marshal as shared values: the first occurrence is
+	// wrapped in tag 28 and the next ones are encoded as tag 29 holding the
+	// index of the marked value, as specified in the "Value Sharing" tags
+	// registration. Cyclic values can then be encoded. Values inside the
+	// items of a sorted map are never marked, since sorting would change
+	// the order of the marks, so ModeSortNone is needed to share them.
+	ModeSharePointers
+)
+
+// ModeNetIP specifies how netip.Addr and netip.Prefix values are encoded.
+// Every mode preserves IPv4-mapped IPv6 addresses and zones.
+type ModeNetIP int
+
+const (
+	// ModeNetIPBinary encodes them as byte strings holding the result of
+	// their MarshalBinary method: the 4 or 16 address bytes followed by
+	// the zone for an address, or by the prefix length for a prefix.
+	ModeNetIPBinary ModeNetIP = iota
+
+	// ModeNetIPText encodes them as text strings holding the result of
+	// their MarshalText method, such as "2001:db8::1%eth0" or "10.0.0.0/8".
+	ModeNetIPText
+
+	// ModeNetIPTag encodes them as specified by RFC 9164, in tag 52 for
+	// IPv4 and tag 54 for IPv6, including IPv4-mapped addresses.
+	// An address is encoded as a byte string, or as an array holding the
+	// address, null and the zone if it has one. A prefix is encoded as
+	// an array holding its length and its bytes without the trailing zero
+	// ones, or holding the address and the length if bits beyond the
+	// length are set. Invalid values are encoded as null.
+	ModeNetIPTag
 )
 
 func Marshal(v interface{}) ([]byte, error) {
@@ -94,21 +308,217 @@ func Marshal(v interface{}) ([]byte, error) {
 	return b.Bytes()
 }
 
+// MarshalTo appends the encoding of v to dst and returns the extended
+// slice, reusing the capacity of dst when possible, as append does.
+func MarshalTo(dst []byte, v interface{}) ([]byte, error) {
+	b := NewBuilder(dst)
+	b.Marshal(v)
+	return b.Bytes()
+}
+
+// MarshalSequence returns the CBOR sequence, as defined in RFC 8742, holding
+// the encoding of each of vs in turn. The items are concatenated without
+// any framing. An error encoding any item is returned for the whole sequence.
+func MarshalSequence(vs ...interface{}) ([]byte, error) {
+	var b Builder
+	for _, v := range vs {
+		b.AddSequenceItem(v)
+	}
+	return b.Bytes()
+}
+
+// EncodedSize returns the number of bytes Marshal(v) would return,
+// or the error it would report, without keeping the encoded bytes.
+func EncodedSize(v interface{}) (int, error) {
+	var b Builder
+	return b.EncodedSize(v)
+}
+
+// EncodedSize returns the number of bytes b.Marshal(v) would append,
+// taking the modes of b into account, without writing to b. The bytes
+// are passed to a counting sink as soon as they are final, so only those
+// of the map being sorted, if any, are buffered. MaxSize applies to the
+// bytes already written to b plus those of v, as it does for Marshal.
+func (b *Builder) EncodedSize(v interface{}) (int, error) {
+	c := *b
+	c.result, c.offsets, c.tmp = nil, nil, nil
+	// Counting from the end of b keeps MaxSize and alignment padding
+	// as they would be in b.
+	base := b.flushed + len(b.result)
+	c.flushed = base
+	c.err = nil
+	c.scopes = 0
+	c.mapBase, c.mapSize, c.mapMaxSize = 0, 0, 0
+	c.sortedItems = 0
+	// Pointers marked by c must not be recorded as marked in b.
+	if b.share.index != nil {
+		c.share.index = make(map[shareKey]uint64, len(b.share.index))
+		for k, i := range b.share.index {
+			c.share.index[k] = i
+		}
+	}
+	c.SetFlushThreshold(1, func([]byte) error { return nil })
+	c.Marshal(v)
+	if err := c.Flush(); err != nil {
+		return 0, err
+	}
+	return c.flushed - base, nil
+}
+
+// CanEncodeDeterministic reports whether v can be encoded using
+// the Core Deterministic Encoding requirements of RFC 8949 section 4.2,
+// which is required before signing or hashing the encoded value.
+// It returns the first problem found, such as a map with two keys
+// that encode to the same bytes or a value of an unsupported type.
+func CanEncodeDeterministic(v interface{}) error {
+	b := CoreDeterministic()
+	b.Marshal(v)
+	_, err := b.Bytes()
+	return err
+}
+
 // BuilderContinuation is a continuation-passing interface
 // for building length-prefixed byte sequences.
 type BuilderContinuation func(*Builder)
 
 type Builder struct {
-	ModeNaN    ModeNaN
-	ModeInf    ModeInf
-	ModeFloat  ModeFloat
-	ModeSort   ModeSort
+	ModeNaN          ModeNaN
+	ModeInf          ModeInf
+	ModeFloat        ModeFloat
+	ModeSort         ModeSort
+	ModeEmptyString  ModeEmptyString
+	ModeDenseIntMap  ModeDenseIntMap
+	ModeTime         ModeTime
+	ModeIndefinite   ModeIndefinite
+	ModeError        ModeError
+	ModeByteSlice    ModeByteSlice
+	ModeComplexArray ModeComplexArray
+	ModeUnsupported  ModeUnsupported
+	ModeIntWidth     ModeIntWidth
+	ModeShare        ModeShare
+	ModeNetIP        ModeNetIP
+
+	// MaxNestingDepth limits how deeply Marshal recurses into nested values,
+	// such as arrays, maps, structs and pointers. Zero means no limit.
+	// Encoding a value that exceeds the limit, for example a cyclic one,
+	// sets an error on the Builder.
+	MaxNestingDepth int
+
+	// MaxSize limits the number of bytes written by the builder, including
+	// those already flushed. Zero means no limit. Appending bytes beyond
+	// the limit sets an error on the Builder.
+	MaxSize int
+
+	// StructAsMap encodes all structs as maps keyed by field name.
+	// Structs with at least one field with a cbor struct tag are always
+	// encoded as maps, other structs are encoded as arrays unless
+	// StructAsMap is set. Structs with a blank field tagged
+	// `cbor:",toarray"` are always encoded as arrays.
+	StructAsMap bool
+
+	// ModeUseJSONTags makes struct fields without a cbor struct tag use
+	// their json struct tag instead, including the "-" and omitempty options.
+	// A cbor tag always takes precedence over a json tag.
+	ModeUseJSONTags bool
+
+	// DetectDuplicateKeys makes encoding a map or a struct as a map set an
+	// error if two of its keys encode to the same bytes, which would
+	// produce an invalid map.
+	DetectDuplicateKeys bool
+
+	// StringerKeys encodes map keys implementing fmt.Stringer as the text
+	// string returned by their String method, taking precedence over any
+	// other encoding of the key. Keys are then sorted according to ModeSort
+	// like any text string, and distinct keys with the same String result
+	// are duplicates for DetectDuplicateKeys.
+	StringerKeys bool
+
+	// ValidateUTF8 makes AddString, and so encoding any Go string,
+	// set an error if the string is not valid UTF-8, which would
+	// produce an invalid text string.
+	ValidateUTF8 bool
+
+	// ModeTextCanonical encodes text strings canonically for signed payloads:
+	// strings must be valid UTF-8 as with ValidateUTF8, empty strings are
+	// encoded as empty text strings regardless of ModeEmptyString, and
+	// indefinite-length text strings set an error.
+	// Text string heads always use their shortest form.
+	ModeTextCanonical bool
+
+	// SelfDescribe makes the first top-level call to Marshal prepend the
+	// self-described CBOR tag 55799 (0xd9d9f7), the magic prefix defined by
+	// RFC 8949 section 3.4.6 that identifies the output as CBOR.
+	SelfDescribe bool
+
+	// Tags registers Go types that are wrapped in a CBOR tag when encoded.
+	// If set, Marshal encodes every value through reflection so that
+	// registered types are found at any depth.
+	Tags *TagSet
+
+	// StripTags holds the tag numbers that AddReencoded drops, keeping
+	// their content, for example to remove a version or self-describe tag
+	// wrapping a received data item before emitting it again.
+	StripTags map[uint64]bool
+
+	flushThreshold int
+	sink           func([]byte) error
+	// flushed counts the bytes already passed to the sink.
+	flushed int
+	// described reports whether the self-described CBOR tag was appended.
+	described bool
+	// leadingSimple is the simple value set with SetLeadingSimpleValue,
+	// if hasLeadingSimple, and leadingDone reports whether it was appended.
+	leadingSimple    uint8
+	hasLeadingSimple bool
+	leadingDone      bool
+	// scopes counts the items being built that may still be
+	// rewritten, which prevents flushing them to the sink.
+	scopes     int
+	depth      int
 	err        error
 	result     []byte
 	offsets    []mapItem
 	tmp        []byte
+	mapBase    int
 	mapSize    int
 	mapMaxSize int
+	// sortedItems is the number of sorted map items being built.
+	sortedItems int
+	share       shareState
+}
+
+// CoreDeterministic returns a Builder that encodes using the Core
+// Deterministic Encoding requirements of RFC 8949 section 4.2.1:
+//   - integers, lengths and tag numbers use their shortest form;
+//   - floats use the shortest of float16, float32 and float64 that
+//     preserves their value, and NaN is encoded as 0xf97e00;
+//   - map keys are sorted in the bytewise lexical order of their encodings;
+//   - indefinite-length items are forbidden;
+//   - maps with two keys that encode to the same bytes set an error.
+func CoreDeterministic() *Builder {
+	return &Builder{
+		ModeNaN:             ModeNaN7e00,
+		ModeInf:             ModeInfFloat16,
+		ModeFloat:           ModeFloat16,
+		ModeSort:            ModeSortBytewiseLexical,
+		ModeIndefinite:      ModeIndefiniteForbid,
+		DetectDuplicateKeys: true,
+	}
+}
+
+// CTAP2Canonical returns a Builder that encodes using the CTAP2 canonical
+// CBOR encoding form of the FIDO Client to Authenticator Protocol:
+// map keys are sorted in bytewise lexical order, floats and infinities are
+// not converted to smaller representations, NaN is encoded as 0xf97e00 and
+// indefinite-length items are forbidden.
+func CTAP2Canonical() *Builder {
+	return &Builder{
+		ModeNaN:        ModeNaN7e00,
+		ModeInf:        ModeInfNone,
+		ModeFloat:      ModeFloatNone,
+		ModeSort:       ModeSortBytewiseLexical,
+		ModeIndefinite: ModeIndefiniteForbid,
+	}
 }
 
 func NewBuilder(buffer []byte) *Builder {
@@ -123,6 +533,37 @@ func (b *Builder) SetError(err error) {
 	b.err = err
 }
 
+// SetLeadingSimpleValue makes the first top-level call to Marshal prepend
+// the simple value v, for example to identify a protocol version, before
+// the encoded document and its self-described CBOR tag, if any.
+// The output is then a CBOR sequence (RFC 8742) of two items, which
+// readers must decode as a sequence.
+func (b *Builder) SetLeadingSimpleValue(v uint8) {
+	b.leadingSimple = v
+	b.hasLeadingSimple = true
+}
+
+// Reset discards the bytes written by the builder and any error, so it can be
+// reused to build a new value while keeping the capacity of its buffers.
+// The modes and the flush threshold are kept. Slices previously returned by
+// Bytes are overwritten by the next writes.
+func (b *Builder) Reset() {
+	b.result = b.result[:0]
+	b.offsets = b.offsets[:0]
+	b.tmp = b.tmp[:0]
+	b.flushed = 0
+	b.described = false
+	b.leadingDone = false
+	b.err = nil
+	b.scopes = 0
+	b.depth = 0
+	b.mapBase = 0
+	b.mapSize = 0
+	b.mapMaxSize = 0
+	b.sortedItems = 0
+	b.share = shareState{}
+}
+
 // Bytes returns the bytes written by the builder or an error if one has
 // occurred during building.
 func (b *Builder) Bytes() ([]byte, error) {
@@ -132,21 +573,107 @@ func (b *Builder) Bytes() ([]byte, error) {
 	return b.result, nil
 }
 
+// Len returns the number of bytes written by the builder
+// and not yet flushed to the sink set with SetFlushThreshold.
 func (b *Builder) Len() int {
 	return len(b.result)
 }
 
+// SetFlushThreshold makes the builder pass its buffered bytes to sink
+// whenever at least n bytes are buffered, so that the memory used to build
+// a large document stays bounded. Bytes that may still be rewritten, such as
+// the items of a map being sorted, are only flushed once they are final.
+// Call Flush once building is done to pass the remaining bytes to sink.
+// If sink returns an error, it is set on the Builder.
+func (b *Builder) SetFlushThreshold(n int, sink func([]byte) error) {
+	b.flushThreshold = n
+	b.sink = sink
+}
+
+// Flush passes the buffered bytes to the sink set with SetFlushThreshold.
+// It is a no-op if no sink is set. Flush must not be called while
+// building a map or a byte string of unknown length.
+func (b *Builder) Flush() error {
+	if b.err != nil || b.sink == nil || len(b.result) == 0 {
+		return b.err
+	}
+	if err := b.sink(b.result); err != nil {
+		b.SetError(err)
+		return err
+	}
+	b.flushed += len(b.result)
+	b.result = b.result[:0]
+	return nil
+}
+
+// PadTo appends padding until the number of bytes written by the builder,
+// including the flushed ones, is a multiple of alignment. The padding is
+// made of one or more zero-filled byte strings appended after the encoded
+// value, so the output becomes a CBOR sequence (RFC 8742) whose trailing
+// items carry no data and can be skipped by the reader.
+func (b *Builder) PadTo(alignment int) {
+	if alignment <= 0 {
+		b.SetError(errors.New("cbor: invalid padding alignment " + strconv.Itoa(alignment)))
+		return
+	}
+	n := (alignment - (b.flushed+b.Len())%alignment) % alignment
+	for n > 0 {
+		// Use the longest byte string with a shortest-form head that fits.
+		l := n - 1
+		for headLength(uint64(l))+l > n {
+			l--
+		}
+		b.addUint64(cborTypeByteString, uint64(l))
+		b.add(make([]byte, l)...)
+		n -= headLength(uint64(l)) + l
+	}
+}
+
+// headLength returns the length of the shortest head holding the argument n.
+func headLength(n uint64) int {
+	switch {
+	case n < 24:
+		return 1
+	case n <= math.MaxUint8:
+		return 2
+	case n <= math.MaxUint16:
+		return 3
+	case n <= math.MaxUint32:
+		return 5
+	}
+	return 9
+}
+
+// overflows reports whether appending m bytes to n bytes exceeds max bytes,
+// or the largest int if max is not positive.
+func overflows(n, m, max int) bool {
+	if max <= 0 {
+		max = math.MaxInt
+	}
+	return m > max || n > max-m
+}
+
 func (b *Builder) add(bytes ...byte) {
 	if b.err != nil {
 		return
 	}
-	if len(b.result)+len(bytes) < len(bytes) {
+	if overflows(len(b.result), len(bytes), 0) {
 		b.err = errors.New("cbor: length overflow")
+		return
+	}
+	if b.MaxSize > 0 && overflows(b.flushed+len(b.result), len(bytes), b.MaxSize) {
+		b.err = errors.New("cbor: encoding exceeds MaxSize (" + strconv.Itoa(b.MaxSize) + ")")
+		return
 	}
 	b.result = append(b.result, bytes...)
+	if b.sink != nil && b.scopes == 0 && len(b.result) >= b.flushThreshold {
+		b.Flush()
+	}
 }
 
 func (b *Builder) addUnknown(t byte, fn BuilderContinuation) {
+	b.scopes++
+	defer func() { b.scopes-- }()
 	offset := b.Len()
 	b.addUint8(t, 0)
 	fn(b)
@@ -178,19 +705,76 @@ func (b *Builder) addUnknown(t byte, fn BuilderContinuation) {
 	}
 }
 
+// enter increments the nesting depth and reports whether it is within
+// MaxNestingDepth. Every successful call must be paired with a call to leave.
+func (b *Builder) enter() bool {
+	b.depth++
+	if b.MaxNestingDepth > 0 && b.depth > b.MaxNestingDepth {
+		b.depth--
+		b.SetError(errors.New("cbor: exceeded max nesting depth"))
+		return false
+	}
+	return true
+}
+
+func (b *Builder) leave() {
+	b.depth--
+}
+
+// AddSequenceItem appends the encoding of v as the next item of a CBOR
+// sequence (RFC 8742), which is a top-level data item following the
+// previous ones. Calling it while a map or an indefinite-length item is
+// being built, or from a MarshalingValue, sets an error.
+func (b *Builder) AddSequenceItem(v interface{}) {
+	if b.depth != 0 || b.scopes != 0 {
+		b.SetError(errors.New("cbor: sequence item inside another data item"))
+		return
+	}
+	// Each item of a sequence is a separate data item,
+	// so marks from the previous ones cannot be referenced.
+	b.share = shareState{}
+	b.Marshal(v)
+}
+
+// Marshal appends the encoding of v.
+//
+// Values implementing MarshalingValue are encoded by MarshalCBORValue,
+// and values implementing Marshaler by MarshalCBOR. Otherwise, values
+// implementing encoding.BinaryMarshaler are encoded as byte strings and
+// values implementing encoding.TextMarshaler as text strings, in that
+// order of precedence. Struct fields are only walked if none applies.
+//
+// Fields of structs encoded as maps with the omitempty or omitzero option
+// are omitted if their value is empty or zero. A pointer field is only
+// empty or zero when nil, so a pointer to a zero value is encoded, which
+// distinguishes an absent field from a field explicitly set to zero.
 func (b *Builder) Marshal(v interface{}) {
 	if b.err != nil {
 		return
 	}
+	if b.hasLeadingSimple && b.depth == 0 && !b.leadingDone {
+		b.leadingDone = true
+		b.AddSimpleValue(b.leadingSimple)
+	}
+	if b.SelfDescribe && b.depth == 0 && !b.described {
+		b.AddSelfDescribeTag()
+	}
+	if b.ModeShare != ModeShareNone && b.depth == 0 {
+		b.share.count(v, b.ModeUseJSONTags)
+	}
+	if !b.enter() {
+		return
+	}
+	defer b.leave()
+	if !b.Tags.empty() || b.ModeShare != ModeShareNone {
+		b.reflectValue(reflect.ValueOf(v))
+		return
+	}
 	switch v := v.(type) {
 	case nil:
 		b.AddNil()
 	case *bool:
-		if v == nil {
-			b.AddNil()
-		} else {
-			b.AddBool(*v)
-		}
+		AddNullable(b, v, (*Builder).AddBool)
 	case bool:
 		b.AddBool(v)
 	case []bool:
@@ -204,11 +788,7 @@ func (b *Builder) Marshal(v interface{}) {
 			})
 		}
 	case *int8:
-		if v == nil {
-			b.AddNil()
-		} else {
-			b.AddInt8(*v)
-		}
+		AddNullable(b, v, (*Builder).AddInt8)
 	case int8:
 		b.AddInt8(v)
 	case []int8:
@@ -222,25 +802,23 @@ func (b *Builder) Marshal(v interface{}) {
 			})
 		}
 	case *uint8:
-		if v == nil {
-			b.AddNil()
-		} else {
-			b.AddUint8(*v)
-		}
+		AddNullable(b, v, (*Builder).AddUint8)
 	case uint8:
 		b.AddUint8(v)
 	case []uint8:
 		if v == nil {
 			b.AddNil()
+		} else if b.ModeByteSlice == ModeByteSliceArray {
+			b.AddArray(uint64(len(v)), func(b *Builder) {
+				for _, x := range v {
+					b.AddUint8(x)
+				}
+			})
 		} else {
 			b.AddBytes(v)
 		}
 	case *int16:
-		if v == nil {
-			b.AddNil()
-		} else {
-			b.AddInt16(*v)
-		}
+		AddNullable(b, v, (*Builder).AddInt16)
 	case int16:
 		b.AddInt16(v)
 	case []int16:
@@ -254,11 +832,7 @@ func (b *Builder) Marshal(v interface{}) {
 			})
 		}
 	case *uint16:
-		if v == nil {
-			b.AddNil()
-		} else {
-			b.AddUint16(*v)
-		}
+		AddNullable(b, v, (*Builder).AddUint16)
 	case uint16:
 		b.AddUint16(v)
 	case []uint16:
@@ -272,11 +846,7 @@ func (b *Builder) Marshal(v interface{}) {
 			})
 		}
 	case *int32:
-		if v == nil {
-			b.AddNil()
-		} else {
-			b.AddInt32(*v)
-		}
+		AddNullable(b, v, (*Builder).AddInt32)
 	case int32:
 		b.AddInt32(v)
 	case []int32:
@@ -290,11 +860,7 @@ func (b *Builder) Marshal(v interface{}) {
 			})
 		}
 	case *uint32:
-		if v == nil {
-			b.AddNil()
-		} else {
-			b.AddUint32(*v)
-		}
+		AddNullable(b, v, (*Builder).AddUint32)
 	case uint32:
 		b.AddUint32(v)
 	case []uint32:
@@ -308,11 +874,7 @@ func (b *Builder) Marshal(v interface{}) {
 			})
 		}
 	case *int64:
-		if v == nil {
-			b.AddNil()
-		} else {
-			b.AddInt64(*v)
-		}
+		AddNullable(b, v, (*Builder).AddInt64)
 	case int64:
 		b.AddInt64(v)
 	case []int64:
@@ -326,11 +888,7 @@ func (b *Builder) Marshal(v interface{}) {
 			})
 		}
 	case *uint64:
-		if v == nil {
-			b.AddNil()
-		} else {
-			b.AddUint64(*v)
-		}
+		AddNullable(b, v, (*Builder).AddUint64)
 	case uint64:
 		b.AddUint64(v)
 	case []uint64:
@@ -344,29 +902,17 @@ func (b *Builder) Marshal(v interface{}) {
 			})
 		}
 	case *int:
-		if v == nil {
-			b.AddNil()
-		} else {
-			b.AddInt(*v)
-		}
+		AddNullable(b, v, (*Builder).AddInt)
 	case int:
 		b.AddInt(v)
 	case []int:
 		if v == nil {
 			b.AddNil()
 		} else {
-			b.AddArray(uint64(len(v)), func(b *Builder) {
-				for _, x := range v {
-					b.AddInt(x)
-				}
-			})
+			b.AddIntArray(v)
 		}
 	case *uint:
-		if v == nil {
-			b.AddNil()
-		} else {
-			b.AddUint(*v)
-		}
+		AddNullable(b, v, (*Builder).AddUint)
 	case uint:
 		b.AddUint(v)
 	case []uint:
@@ -380,11 +926,7 @@ func (b *Builder) Marshal(v interface{}) {
 			})
 		}
 	case *float32:
-		if v == nil {
-			b.AddNil()
-		} else {
-			b.AddFloat32(*v)
-		}
+		AddNullable(b, v, (*Builder).AddFloat32)
 	case float32:
 		b.AddFloat32(v)
 	case []float32:
@@ -398,31 +940,59 @@ func (b *Builder) Marshal(v interface{}) {
 			})
 		}
 	case *float64:
+		AddNullable(b, v, (*Builder).AddFloat64)
+	case float64:
+		b.AddFloat64(v)
+	case []float64:
 		if v == nil {
 			b.AddNil()
 		} else {
-			b.AddFloat64(*v)
+			b.AddFloat64Array(v)
 		}
-	case float64:
-		b.AddFloat64(v)
-	case []float64:
+	case []complex128:
+		if v == nil {
+			b.AddNil()
+		} else {
+			b.AddComplex128Array(v)
+		}
+	case *string:
+		AddNullable(b, v, (*Builder).AddString)
+	case string:
+		b.AddString(v)
+	case big.Int:
+		b.AddBigInt(&v)
+	case *big.Int:
+		b.AddBigInt(v)
+	case big.Float:
+		b.AddBigFloat(&v)
+	case *big.Float:
+		b.AddBigFloat(v)
+	case big.Rat:
+		b.AddBigRat(&v)
+	case *big.Rat:
+		b.AddBigRat(v)
+	case *regexp.Regexp:
+		b.AddRegexp(v)
+	case []big.Int:
 		if v == nil {
 			b.AddNil()
 		} else {
 			b.AddArray(uint64(len(v)), func(b *Builder) {
-				for _, x := range v {
-					b.AddFloat64(x)
+				for i := range v {
+					b.AddBigInt(&v[i])
 				}
 			})
 		}
-	case *string:
+	case []*big.Int:
 		if v == nil {
 			b.AddNil()
 		} else {
-			b.AddString(*v)
+			b.AddArray(uint64(len(v)), func(b *Builder) {
+				for _, x := range v {
+					b.AddBigInt(x)
+				}
+			})
 		}
-	case string:
-		b.AddString(v)
 	case []interface{}:
 		if v == nil {
 			b.AddNil()
@@ -440,12 +1010,32 @@ func (b *Builder) Marshal(v interface{}) {
 			b.AddMap(len(v))
 			for k, v := range v {
 				b.AddMapItem(func(b *Builder) {
+					if s, ok := b.stringerKey(reflect.ValueOf(k)); ok {
+						b.AddString(s)
+						return
+					}
 					b.Marshal(k)
 				}, func(b *Builder) {
 					b.Marshal(v)
 				})
 			}
 		}
+	case map[string]interface{}:
+		b.addStringMap(v)
+	case []map[string]interface{}:
+		if v == nil {
+			b.AddNil()
+		} else {
+			b.AddArray(uint64(len(v)), func(b *Builder) {
+				for _, m := range v {
+					if !b.enter() {
+						return
+					}
+					b.addStringMap(m)
+					b.leave()
+				}
+			})
+		}
 	case MarshalingValue:
 		if v == nil {
 			b.AddNil()
@@ -454,9 +1044,28 @@ func (b *Builder) Marshal(v interface{}) {
 				b.SetError(err)
 			}
 		}
+	case Marshaler:
+		b.addMarshaler(v)
 	default:
 		// Fallback to reflect-based encoding.
-		b.value(reflect.Indirect(reflect.ValueOf(v)))
+		b.reflectValue(reflect.Indirect(reflect.ValueOf(v)))
+	}
+}
+
+// addStringMap appends m as a map with text string keys,
+// sorted according to ModeSort.
+func (b *Builder) addStringMap(m map[string]interface{}) {
+	if m == nil {
+		b.AddNil()
+		return
+	}
+	b.AddMap(len(m))
+	for k, v := range m {
+		b.AddMapItem(func(b *Builder) {
+			b.AddString(k)
+		}, func(b *Builder) {
+			b.Marshal(v)
+		})
 	}
 }
 
@@ -464,59 +1073,104 @@ func (b *Builder) value(v reflect.Value) {
 	if b.err != nil {
 		return
 	}
+	if !b.enter() {
+		return
+	}
+	defer b.leave()
+	b.reflectValue(v)
+}
+
+func (b *Builder) reflectValue(v reflect.Value) {
 	k := v.Kind()
-	if !v.IsValid() {
+	// Nil pointers, at any level, are encoded as null before looking up
+	// the type, so that neither tags nor DecimalFuncs registered for
+	// a pointer type are applied to them.
+	if !v.IsValid() || (k == reflect.Ptr && v.IsNil()) {
 		b.AddNil()
 		return
 	}
 	t := v.Type()
+	if fn, ok := b.Tags.decimal(t); ok {
+		exp, coefficient := fn(v.Interface())
+		b.AddDecimalFraction(coefficient, exp)
+		return
+	}
+	if num, ok := b.Tags.tag(t); ok {
+		b.AddTag(num)
+	}
 	switch t {
 	case typeBigInt:
 		vbi := v.Interface().(big.Int)
-		sign := vbi.Sign()
-		bi := new(big.Int).SetBytes(vbi.Bytes()) // bi is absolute value of v
-		if sign < 0 {
-			// For negative number, convert to CBOR encoded number (-v-1).
-			bi.Sub(bi, big.NewInt(1))
-		}
-		if bi.IsUint64() {
-			if sign >= 0 {
-				b.addUint64(cborTypePositiveInt, bi.Uint64())
-			} else {
-				b.addUint64(cborTypeNegativeInt, bi.Uint64())
+		b.AddBigInt(&vbi)
+		return
+	case typeBigFloat:
+		vbf := v.Interface().(big.Float)
+		b.AddBigFloat(&vbf)
+		return
+	case typeBigRat:
+		vbr := v.Interface().(big.Rat)
+		b.AddBigRat(&vbr)
+		return
+	case typeTime:
+		b.AddTime(v.Interface().(time.Time))
+		return
+	case typeRegexp:
+		re := v.Interface().(regexp.Regexp)
+		b.AddRegexp(&re)
+		return
+	case typeNetIPAddr:
+		b.AddNetIPAddr(v.Interface().(netip.Addr))
+		return
+	case typeNetIPPrefix:
+		b.AddNetIPPrefix(v.Interface().(netip.Prefix))
+		return
+	}
+	if implementsEncoder(t) {
+		if m, ok := asInterface(v, typeMarshalingValue); ok {
+			if err := m.(MarshalingValue).MarshalCBORValue(b); err != nil {
+				b.SetError(err)
 			}
 			return
 		}
-		var tagNum uint64 = 2
-		if sign < 0 {
-			tagNum = 3
+		if m, ok := asInterface(v, typeMarshaler); ok {
+			b.addMarshaler(m.(Marshaler))
+			return
 		}
-		b.AddTag(tagNum)
-		b.AddBytes(bi.Bytes())
-		return
-	}
-	if reflect.PtrTo(t).Implements(typeMarshalingValue) {
-		m, ok := v.Interface().(MarshalingValue)
-		if !ok {
-			pv := reflect.New(v.Type())
-			pv.Elem().Set(v)
-			m = pv.Interface().(MarshalingValue)
+		if b.ModeError != ModeErrorNone {
+			if m, ok := asInterface(v, typeError); ok {
+				b.addError(m.(error), 0)
+				return
+			}
 		}
-		if err := m.MarshalCBORValue(b); err != nil {
-			b.SetError(err)
+		if m, ok := asInterface(v, typeBinaryMarshaler); ok {
+			data, err := m.(encoding.BinaryMarshaler).MarshalBinary()
+			if err != nil {
+				b.SetError(err)
+				return
+			}
+			b.AddBytes(data)
+			return
+		}
+		if m, ok := asInterface(v, typeTextMarshaler); ok {
+			text, err := m.(encoding.TextMarshaler).MarshalText()
+			if err != nil {
+				b.SetError(err)
+				return
+			}
+			b.AddString(string(text))
+			return
 		}
-		return
 	}
 	switch k {
 	case reflect.String:
 		b.AddString(v.String())
 	case reflect.Array, reflect.Slice:
+		if k == reflect.Slice && v.IsNil() {
+			b.AddNil()
+			break
+		}
 		l := v.Len()
-		if t.Elem().Kind() == reflect.Uint8 {
-			if k == reflect.Slice && v.IsNil() {
-				b.AddNil()
-				break
-			}
+		if t.Elem().Kind() == reflect.Uint8 && b.ModeByteSlice == ModeByteSliceByteString {
 			if l == 0 {
 				b.addUint8(cborTypeByteString, 0)
 				break
@@ -526,7 +1180,23 @@ func (b *Builder) value(v reflect.Value) {
 				b.add(byte(v.Index(i).Uint()))
 			}
 
-		} else {
+		} else if t.Elem().Kind() == reflect.Ptr {
+			// Slices of pointers, such as []*T, are common enough to
+			// dereference their elements here instead of in value.
+			b.AddArray(uint64(l), func(b *Builder) {
+				for i := 0; i < l; i++ {
+					e := v.Index(i)
+					if e.IsNil() {
+						b.AddNil()
+					} else if b.ModeShare != ModeShareNone && b.addShared(e) {
+						// A reference to the marked value was appended.
+					} else if b.enter() {
+						b.value(e.Elem())
+						b.leave()
+					}
+				}
+			})
+		} else {
 			b.AddArray(uint64(l), func(b *Builder) {
 				for i := 0; i < l; i++ {
 					b.value(v.Index(i))
@@ -542,21 +1212,17 @@ func (b *Builder) value(v reflect.Value) {
 		iter := v.MapRange()
 		for iter.Next() {
 			b.AddMapItem(func(b *Builder) {
+				if s, ok := b.stringerKey(iter.Key()); ok {
+					b.AddString(s)
+					return
+				}
 				b.value(iter.Key())
 			}, func(b *Builder) {
 				b.value(iter.Value())
 			})
 		}
 	case reflect.Struct:
-		t := v.Type()
-		l := v.NumField()
-		b.AddArray(uint64(l), func(b *Builder) {
-			for i := 0; i < l; i++ {
-				if v := v.Field(i); v.CanSet() || t.Field(i).Name != "_" {
-					b.value(v)
-				}
-			}
-		})
+		b.addStruct(v)
 
 	case reflect.Bool:
 		b.AddBool(v.Bool())
@@ -584,18 +1250,236 @@ func (b *Builder) value(v reflect.Value) {
 				b.AddFloat32(float32(imag(x)))
 			case reflect.Complex128:
 				x := v.Complex()
-				b.AddFloat64(float64(real(x)))
+				b.AddFloat64(real(x))
+				b.AddFloat64(imag(x))
 			}
 		})
+	case reflect.Ptr:
+		if b.ModeShare != ModeShareNone && b.addShared(v) {
+			break
+		}
+		b.value(v.Elem())
 	case reflect.Interface:
 		if v.IsNil() {
 			b.AddNil()
 			break
 		}
-		b.value(v.Elem())
+		// The dynamic value is not nested in the interface,
+		// so it doesn't count as a nesting level.
+		b.reflectValue(v.Elem())
+	case reflect.Chan, reflect.Func, reflect.UnsafePointer:
+		switch {
+		case v.IsNil() && b.ModeUnsupported == ModeUnsupportedNilNull:
+			b.AddNil()
+		case v.IsNil() && b.ModeUnsupported == ModeUnsupportedNilUndefined:
+			b.AddUndefined()
+		default:
+			b.SetError(errors.New("cbor: invalid type " + v.Type().String()))
+		}
 	default:
-		b.SetError(errors.New("cbor: invalid type" + v.String()))
+		b.SetError(errors.New("cbor: invalid type " + v.String()))
+	}
+}
+
+// addError appends err as specified by ModeError.
+// depth is the number of causes already encoded.
+func (b *Builder) addError(err error, depth int) {
+	if b.ModeError == ModeErrorString {
+		b.AddString(err.Error())
+		return
+	}
+	cause := errors.Unwrap(err)
+	n := 2
+	if cause != nil && depth < maxErrorCauses {
+		n++
+	}
+	b.AddMap(n)
+	b.AddMapItem(func(b *Builder) {
+		b.AddString("type")
+	}, func(b *Builder) {
+		b.AddString(reflect.TypeOf(err).String())
+	})
+	b.AddMapItem(func(b *Builder) {
+		b.AddString("message")
+	}, func(b *Builder) {
+		b.AddString(err.Error())
+	})
+	if n == 3 {
+		b.AddMapItem(func(b *Builder) {
+			b.AddString("cause")
+		}, func(b *Builder) {
+			b.addError(cause, depth+1)
+		})
+	}
+}
+
+// addMarshaler appends the encoding returned by m.MarshalCBOR.
+func (b *Builder) addMarshaler(m Marshaler) {
+	data, err := m.MarshalCBOR()
+	if err != nil {
+		b.SetError(err)
+		return
+	}
+	b.AddRawBytes(data)
+}
+
+var encoderTypeCache sync.Map // map[reflect.Type]bool
+
+// implementsEncoder reports whether values of type t might be encoded
+// through one of the interfaces checked by asInterface, using a cache
+// so the method sets of t are only inspected once.
+func implementsEncoder(t reflect.Type) bool {
+	if ok, found := encoderTypeCache.Load(t); found {
+		return ok.(bool)
+	}
+	ok := false
+	if k := t.Kind(); k != reflect.Ptr && k != reflect.Interface {
+		pt := reflect.PtrTo(t)
+		for _, it := range []reflect.Type{typeMarshalingValue, typeMarshaler, typeError, typeBinaryMarshaler, typeTextMarshaler} {
+			if t.Implements(it) || pt.Implements(it) {
+				ok = true
+				break
+			}
+		}
+	}
+	encoderTypeCache.Store(t, ok)
+	return ok
+}
+
+// stringer is fmt.Stringer.
+type stringer interface {
+	String() string
+}
+
+var typeStringer = reflect.TypeOf((*stringer)(nil)).Elem()
+
+// stringerKey returns the String method result of the map key k
+// if StringerKeys is set and k implements it.
+func (b *Builder) stringerKey(k reflect.Value) (string, bool) {
+	if !b.StringerKeys {
+		return "", false
+	}
+	if k.Kind() == reflect.Interface {
+		k = k.Elem()
+	}
+	if k.Kind() == reflect.Ptr {
+		if k.IsNil() || !k.Type().Implements(typeStringer) {
+			return "", false
+		}
+		return k.Interface().(stringer).String(), true
+	}
+	if !k.IsValid() {
+		return "", false
+	}
+	if s, ok := asInterface(k, typeStringer); ok {
+		return s.(stringer).String(), true
+	}
+	return "", false
+}
+
+// asInterface returns v as an implementation of the interface type it.
+// If only the pointer type of v implements it, a pointer to a copy of v
+// is returned. Pointers and interfaces are never reported as implementing it,
+// their elements are checked once dereferenced.
+func asInterface(v reflect.Value, it reflect.Type) (interface{}, bool) {
+	if k := v.Kind(); k == reflect.Ptr || k == reflect.Interface {
+		return nil, false
+	}
+	t := v.Type()
+	if t.Implements(it) {
+		return v.Interface(), true
+	}
+	if reflect.PtrTo(t).Implements(it) {
+		pv := reflect.New(t)
+		pv.Elem().Set(v)
+		return pv.Interface(), true
+	}
+	return nil, false
+}
+
+func (b *Builder) addStruct(v reflect.Value) {
+	fields := cachedFields(v.Type(), b.ModeUseJSONTags)
+	if fields.err != nil {
+		b.SetError(fields.err)
+		return
+	}
+	if fields.toArray || (!b.StructAsMap && !fields.tagged) {
+		b.AddArray(uint64(len(fields.list)), func(b *Builder) {
+			for i := range fields.list {
+				f := &fields.list[i]
+				// Fields promoted through a nil embedded struct pointer
+				// are encoded as null to preserve the array positions.
+				fv, _ := fieldByIndex(v, f.index)
+				b.field(f, fv)
+			}
+		})
+		return
+	}
+	// The map header is length-prefixed, so omitted fields
+	// have to be known before encoding any of them.
+	omit := func(f *field) (reflect.Value, bool) {
+		fv, ok := fieldByIndex(v, f.index)
+		return fv, !ok || (f.omitEmpty && isEmptyValue(fv)) || (f.omitZero && isZeroValue(fv))
+	}
+	n := 0
+	for i := range fields.list {
+		if _, omitted := omit(&fields.list[i]); !omitted {
+			n++
+		}
+	}
+	b.AddMap(n)
+	for i := range fields.list {
+		f := &fields.list[i]
+		fv, omitted := omit(f)
+		if omitted {
+			continue
+		}
+		b.AddMapItem(func(b *Builder) {
+			if f.keyAsInt {
+				b.AddInt64(f.keyInt)
+			} else {
+				b.AddString(f.name)
+			}
+		}, func(b *Builder) {
+			b.field(f, fv)
+		})
+	}
+}
+
+// field appends the value v of the struct field f.
+func (b *Builder) field(f *field, v reflect.Value) {
+	if f.char && v.IsValid() {
+		r := rune(v.Int())
+		if !utf8.ValidRune(r) {
+			b.SetError(errors.New("cbor: invalid rune " + strconv.FormatInt(int64(r), 10) + " for char field " + f.name))
+			return
+		}
+		b.AddString(string(r))
+		return
+	}
+	b.value(v)
+}
+
+// AddNullable appends null if v is nil, otherwise it calls enc with the value v points to.
+func AddNullable[T any](b *Builder, v *T, enc func(*Builder, T)) {
+	if v == nil {
+		b.AddNil()
+		return
 	}
+	enc(b, *v)
+}
+
+// AddOptional appends null if v is equal to zero, otherwise it calls enc with v.
+// It appends null rather than nothing in every position, including map values,
+// because the number of items of an array or a map is encoded before them.
+// To omit a map item as the omitempty option does, compare v with zero
+// before counting and adding the item.
+func AddOptional[T comparable](b *Builder, v T, zero T, enc func(*Builder, T)) {
+	if v == zero {
+		b.AddNil()
+		return
+	}
+	enc(b, v)
 }
 
 // AddValue calls MarshalCBORValue on v, passing a pointer to the builder to append to.
@@ -620,8 +1504,16 @@ func (b *Builder) AddBool(v bool) {
 	b.add(d)
 }
 
+// fixedWidth reports whether heads of major type t
+// use the 9-byte form because of ModeIntWidth.
+func (b *Builder) fixedWidth(t uint8) bool {
+	return b.ModeIntWidth == ModeIntWidthFixed64 && (t == cborTypePositiveInt || t == cborTypeNegativeInt)
+}
+
 func (b *Builder) addUint8(t uint8, v uint8) {
-	if v <= 23 {
+	if b.fixedWidth(t) {
+		b.addUint64(t, uint64(v))
+	} else if v <= 23 {
 		b.add(t | v)
 	} else {
 		b.add(t|byte(24), v)
@@ -629,7 +1521,9 @@ func (b *Builder) addUint8(t uint8, v uint8) {
 }
 
 func (b *Builder) addUint16(t uint8, v uint16) {
-	if v <= math.MaxUint8 {
+	if b.fixedWidth(t) {
+		b.addUint64(t, uint64(v))
+	} else if v <= math.MaxUint8 {
 		b.addUint8(t, uint8(v))
 	} else {
 		b.add(t|byte(25), byte(v>>8), byte(v))
@@ -637,7 +1531,9 @@ func (b *Builder) addUint16(t uint8, v uint16) {
 }
 
 func (b *Builder) addUint32(t uint8, v uint32) {
-	if v <= math.MaxUint8 {
+	if b.fixedWidth(t) {
+		b.addUint64(t, uint64(v))
+	} else if v <= math.MaxUint8 {
 		b.addUint8(t, uint8(v))
 	} else if v <= math.MaxUint16 {
 		b.addUint16(t, uint16(v))
@@ -647,11 +1543,12 @@ func (b *Builder) addUint32(t uint8, v uint32) {
 }
 
 func (b *Builder) addUint64(t uint8, v uint64) {
-	if v <= math.MaxUint8 {
+	fixed := b.fixedWidth(t)
+	if !fixed && v <= math.MaxUint8 {
 		b.addUint8(t, uint8(v))
-	} else if v <= math.MaxUint16 {
+	} else if !fixed && v <= math.MaxUint16 {
 		b.addUint16(t, uint16(v))
-	} else if v <= math.MaxUint32 {
+	} else if !fixed && v <= math.MaxUint32 {
 		b.addUint32(t, uint32(v))
 	} else {
 		b.add(
@@ -666,7 +1563,7 @@ func (b *Builder) AddInt8(v int8) {
 	if v >= 0 {
 		b.AddUint8(uint8(v))
 	} else {
-		b.addUint8(cborTypeNegativeInt, uint8(v*(-1)-1))
+		b.addUint8(cborTypeNegativeInt, uint8(^v))
 	}
 }
 
@@ -674,7 +1571,7 @@ func (b *Builder) AddInt16(v int16) {
 	if v >= 0 {
 		b.AddUint16(uint16(v))
 	} else {
-		b.addUint16(cborTypeNegativeInt, uint16(v*(-1)-1))
+		b.addUint16(cborTypeNegativeInt, uint16(^v))
 	}
 }
 
@@ -682,7 +1579,7 @@ func (b *Builder) AddInt32(v int32) {
 	if v >= 0 {
 		b.AddUint32(uint32(v))
 	} else {
-		b.addUint32(cborTypeNegativeInt, uint32(v*(-1)-1))
+		b.addUint32(cborTypeNegativeInt, uint32(^v))
 	}
 }
 
@@ -690,10 +1587,12 @@ func (b *Builder) AddInt64(v int64) {
 	if v >= 0 {
 		b.AddUint64(uint64(v))
 	} else {
-		b.addUint64(cborTypeNegativeInt, uint64(v*(-1)-1))
+		b.addUint64(cborTypeNegativeInt, uint64(^v))
 	}
 }
 
+// AddInt appends v using the shortest head that holds its value,
+// regardless of the size of int on the target platform.
 func (b *Builder) AddInt(v int) {
 	b.AddInt64(int64(v))
 }
@@ -714,11 +1613,16 @@ func (b *Builder) AddUint64(v uint64) {
 	b.addUint64(cborTypePositiveInt, v)
 }
 
+// AddUint appends v using the shortest head that holds its value,
+// regardless of the size of uint on the target platform.
 func (b *Builder) AddUint(v uint) {
 	b.addUint64(cborTypePositiveInt, uint64(v))
 }
 
-func (b *Builder) addFloat16(v float16.Float16) {
+// AddFloat16 appends v as a half-precision float, regardless of ModeFloat,
+// ModeNaN and ModeInf. Use float16.Fromfloat32 or float16.Frombits to
+// build v, the caller is responsible for the conversion being exact.
+func (b *Builder) AddFloat16(v float16.Float16) {
 	f := uint16(v)
 	b.add(cborTypePrimitives|byte(25), byte(f>>8), byte(f))
 }
@@ -739,11 +1643,24 @@ func (b *Builder) addFloat64(v float64) {
 
 func (b *Builder) AddFloat32(v float32) {
 	if math.IsNaN(float64(v)) {
-		if b.ModeNaN == ModeNaN7e00 {
+		switch b.ModeNaN {
+		case ModeNaN7e00:
 			b.add(cborNaN...)
 			return
+		case ModeNaNReject:
+			b.SetError(errors.New("cbor: NaN not permitted"))
+			return
+		case ModeNaNPreservePayload:
+			// Widen the bits by hand, the conversion could quiet the NaN.
+			f := uint64(math.Float32bits(v))
+			b.addNaNPayload(f>>31<<63 | 0x7ff<<52 | (f&(1<<23-1))<<29)
+			return
 		}
 	} else if math.IsInf(float64(v), 0) {
+		if b.ModeInf == ModeInfReject {
+			b.SetError(errors.New("cbor: Infinity not permitted"))
+			return
+		}
 		if b.ModeInf == ModeInfFloat16 {
 			if v > 0 {
 				b.add(cborPositiveInfinity...)
@@ -767,7 +1684,7 @@ func (b *Builder) AddFloat32(v float32) {
 			}
 		}
 		if p == float16.PrecisionExact {
-			b.addFloat16(f16)
+			b.AddFloat16(f16)
 			return
 		}
 	}
@@ -776,11 +1693,22 @@ func (b *Builder) AddFloat32(v float32) {
 
 func (b *Builder) AddFloat64(v float64) {
 	if math.IsNaN(float64(v)) {
-		if b.ModeNaN == ModeNaN7e00 {
+		switch b.ModeNaN {
+		case ModeNaN7e00:
 			b.add(cborNaN...)
 			return
+		case ModeNaNReject:
+			b.SetError(errors.New("cbor: NaN not permitted"))
+			return
+		case ModeNaNPreservePayload:
+			b.addNaNPayload(math.Float64bits(v))
+			return
 		}
 	} else if math.IsInf(float64(v), 0) {
+		if b.ModeInf == ModeInfReject {
+			b.SetError(errors.New("cbor: Infinity not permitted"))
+			return
+		}
 		if b.ModeInf == ModeInfFloat16 {
 			if v > 0 {
 				b.add(cborPositiveInfinity...)
@@ -797,11 +1725,231 @@ func (b *Builder) AddFloat64(v float64) {
 	}
 }
 
+// addNaNPayload appends the NaN with the float64 bits f in the shortest
+// format holding its sign, quiet bit and payload exactly. The bits are
+// narrowed by hand because float conversions could quiet the NaN.
+func (b *Builder) addNaNPayload(f uint64) {
+	sign, m := f>>63, f&(1<<52-1)
+	if m&(1<<29-1) != 0 {
+		b.add(
+			cborTypePrimitives|byte(27),
+			byte(f>>56), byte(f>>48), byte(f>>40), byte(f>>32),
+			byte(f>>24), byte(f>>16), byte(f>>8), byte(f),
+		)
+		return
+	}
+	m >>= 29
+	if m&(1<<13-1) != 0 {
+		f32 := uint32(sign<<31 | 0xff<<23 | m)
+		b.add(cborTypePrimitives|byte(26), byte(f32>>24), byte(f32>>16), byte(f32>>8), byte(f32))
+		return
+	}
+	m >>= 13
+	b.AddFloat16(float16.Float16(sign<<15 | 0x1f<<10 | m))
+}
+
 func cannotFitFloat32(v float64) bool {
 	f32 := float32(v)
 	return float64(f32) != v
 }
 
+// AddBigInt appends v as an integer if its magnitude fits in 64 bits,
+// else as a positive (tag 2) or negative (tag 3) bignum holding the
+// big-endian bytes of its magnitude. A nil v is encoded as null.
+func (b *Builder) AddBigInt(v *big.Int) {
+	if v == nil {
+		b.AddNil()
+		return
+	}
+	sign := v.Sign()
+	bi := new(big.Int).SetBytes(v.Bytes()) // bi is absolute value of v
+	if sign < 0 {
+		// For negative number, convert to CBOR encoded number (-v-1).
+		bi.Sub(bi, big.NewInt(1))
+	}
+	if bi.IsUint64() {
+		if sign >= 0 {
+			b.addUint64(cborTypePositiveInt, bi.Uint64())
+		} else {
+			b.addUint64(cborTypeNegativeInt, bi.Uint64())
+		}
+		return
+	}
+	var tagNum uint64 = 2
+	if sign < 0 {
+		tagNum = 3
+	}
+	b.AddTag(tagNum)
+	b.AddBytes(bi.Bytes())
+}
+
+// AddRegexp appends the pattern of re as a regular expression (tag 35).
+// A nil re is encoded as null.
+func (b *Builder) AddRegexp(re *regexp.Regexp) {
+	if re == nil {
+		b.AddNil()
+		return
+	}
+	b.AddTag(35)
+	b.AddString(re.String())
+}
+
+// AddNetIPAddr appends the IP address a as specified by ModeNetIP.
+func (b *Builder) AddNetIPAddr(a netip.Addr) {
+	switch b.ModeNetIP {
+	case ModeNetIPText:
+		text, _ := a.MarshalText()
+		b.AddString(string(text))
+		return
+	case ModeNetIPTag:
+		if !a.IsValid() {
+			b.AddNil()
+			return
+		}
+		b.addNetIPTag(a)
+		if a.Zone() == "" {
+			b.AddBytes(a.AsSlice())
+			return
+		}
+		b.AddArray(3, func(b *Builder) {
+			b.AddBytes(a.AsSlice())
+			b.AddNil()
+			b.AddString(a.Zone())
+		})
+		return
+	}
+	data, _ := a.MarshalBinary()
+	b.AddBytes(data)
+}
+
+// AddNetIPPrefix appends the IP prefix p as specified by ModeNetIP.
+func (b *Builder) AddNetIPPrefix(p netip.Prefix) {
+	switch b.ModeNetIP {
+	case ModeNetIPText:
+		text, err := p.MarshalText()
+		if err != nil {
+			b.SetError(err)
+			return
+		}
+		b.AddString(string(text))
+		return
+	case ModeNetIPTag:
+		if !p.IsValid() {
+			b.AddNil()
+			return
+		}
+		b.addNetIPTag(p.Addr())
+		b.AddArray(2, func(b *Builder) {
+			if p != p.Masked() {
+				b.AddBytes(p.Addr().AsSlice())
+				b.AddInt(p.Bits())
+				return
+			}
+			b.AddInt(p.Bits())
+			b.AddBytes(bytes.TrimRight(p.Addr().AsSlice(), "\x00"))
+		})
+		return
+	}
+	data, err := p.MarshalBinary()
+	if err != nil {
+		b.SetError(err)
+		return
+	}
+	b.AddBytes(data)
+}
+
+// addNetIPTag appends the RFC 9164 tag for the family of a.
+func (b *Builder) addNetIPTag(a netip.Addr) {
+	if a.Is4() {
+		b.AddTag(52)
+	} else {
+		b.AddTag(54)
+	}
+}
+
+// AddTime appends t as a tagged date/time, as specified by ModeTime.
+func (b *Builder) AddTime(t time.Time) {
+	switch b.ModeTime {
+	case ModeTimeUnix:
+		b.AddTag(1)
+		if t.Nanosecond() == 0 {
+			b.AddInt64(t.Unix())
+		} else {
+			b.AddFloat64(unixFloat(t))
+		}
+	case ModeTimeUnixFloat:
+		b.AddTag(1)
+		b.AddFloat64(unixFloat(t))
+	default:
+		b.AddTag(0)
+		b.AddString(t.Format(time.RFC3339Nano))
+	}
+}
+
+// unixFloat returns t as the number of seconds elapsed since the Unix epoch.
+func unixFloat(t time.Time) float64 {
+	return float64(t.Unix()) + float64(t.Nanosecond())/1e9
+}
+
+// AddBigFloat appends v as a bigfloat (tag 5) whose content is the array
+// [exponent, mantissa] representing the exact value mantissa*2^exponent.
+// The mantissa is encoded as an integer or as a bignum depending on its size.
+// A nil v is encoded as null. Infinity can't be represented and sets an error.
+func (b *Builder) AddBigFloat(v *big.Float) {
+	if v == nil {
+		b.AddNil()
+		return
+	}
+	if v.IsInf() {
+		b.SetError(errors.New("cbor: cannot encode infinite big.Float"))
+		return
+	}
+	// v = mant × 2^exp with 0.5 <= |mant| < 1, scaling mant by its
+	// minimum precision makes it the smallest possible integer.
+	mant := new(big.Float)
+	exp := v.MantExp(mant)
+	prec := int(v.MinPrec())
+	mant.SetMantExp(mant, prec)
+	m, _ := mant.Int(nil)
+	b.AddTag(5)
+	b.AddArray(2, func(b *Builder) {
+		b.AddInt(exp - prec)
+		b.AddBigInt(m)
+	})
+}
+
+// AddBigRat appends v as a rational number (tag 30) whose content is the
+// array [numerator, denominator] in lowest terms. Each element is encoded
+// as an integer or as a bignum depending on its size.
+// A nil v is encoded as null.
+func (b *Builder) AddBigRat(v *big.Rat) {
+	if v == nil {
+		b.AddNil()
+		return
+	}
+	b.AddTag(30)
+	b.AddArray(2, func(b *Builder) {
+		b.AddBigInt(v.Num())
+		b.AddBigInt(v.Denom())
+	})
+}
+
+// AddDecimalFraction appends the decimal fraction (tag 4) whose content is
+// the array [exponent, mantissa], representing the exact value
+// mantissa*10^exponent. The mantissa is encoded as an integer or as a
+// bignum depending on its size.
+func (b *Builder) AddDecimalFraction(mantissa *big.Int, exponent int64) {
+	if mantissa == nil {
+		b.SetError(errors.New("cbor: nil decimal fraction mantissa"))
+		return
+	}
+	b.AddTag(4)
+	b.AddArray(2, func(b *Builder) {
+		b.AddInt64(exponent)
+		b.AddBigInt(mantissa)
+	})
+}
+
 func (b *Builder) AddBytes(v []byte) {
 	if v == nil {
 		b.add(cborNil)
@@ -820,7 +1968,15 @@ func (b *Builder) AddBytesUnknownLength(fn BuilderContinuation) {
 }
 
 func (b *Builder) AddString(v string) {
+	if (b.ValidateUTF8 || b.ModeTextCanonical) && !utf8.ValidString(v) {
+		b.SetError(errors.New("cbor: invalid UTF-8 in text string"))
+		return
+	}
 	if len(v) == 0 {
+		if b.ModeEmptyString == ModeEmptyStringNull && !b.ModeTextCanonical {
+			b.add(cborNil)
+			return
+		}
 		b.add(cborTypeTextString)
 		return
 	}
@@ -828,17 +1984,370 @@ func (b *Builder) AddString(v string) {
 	b.add([]byte(v)...)
 }
 
+// AddStringIndefinite appends an indefinite-length text string whose chunks
+// are appended by fn, typically with AddString. Each chunk must be a
+// definite-length text string, else an error is set. The chunks are kept
+// in the buffer until fn returns so they can be validated.
+func (b *Builder) AddStringIndefinite(fn BuilderContinuation) {
+	if b.ModeTextCanonical {
+		b.SetError(errors.New("cbor: indefinite-length text strings are not canonical"))
+		return
+	}
+	b.addIndefinite(cborTypeTextString, fn)
+}
+
+// AddBytesIndefinite appends an indefinite-length byte string whose chunks
+// are appended by fn, typically with AddBytes, which writes the head and
+// the content of each chunk. Each chunk must be a definite-length byte
+// string, else an error is set. The chunks are kept in the buffer until
+// fn returns so they can be validated.
+func (b *Builder) AddBytesIndefinite(fn BuilderContinuation) {
+	b.addIndefinite(cborTypeByteString, fn)
+}
+
+func (b *Builder) addIndefinite(t byte, fn BuilderContinuation) {
+	if !b.checkIndefinite() {
+		return
+	}
+	b.scopes++
+	defer func() { b.scopes-- }()
+	b.add(t | 31)
+	offset := len(b.result)
+	fn(b)
+	if b.err != nil {
+		return
+	}
+	chunks := b.result[offset:]
+	for len(chunks) > 0 {
+		major, n, size, err := readHead(chunks)
+		if err != nil || major != t || n > uint64(len(chunks)-size) {
+			b.SetError(errors.New("cbor: invalid chunk in indefinite-length string"))
+			return
+		}
+		chunks = chunks[size+int(n):]
+	}
+	b.add(cborBreak)
+}
+
 func (b *Builder) AddNil() {
 	b.add(cborNil)
 }
 
+// AddUndefined appends the simple value undefined.
+func (b *Builder) AddUndefined() {
+	b.add(cborUndefined)
+}
+
+// AddSimpleValue appends the simple value v, using the one-byte form for
+// values up to 23 and the two-byte form otherwise. Values 24 to 31 are
+// reserved by RFC 8949 section 3.3 and set an error.
+func (b *Builder) AddSimpleValue(v uint8) {
+	switch {
+	case v < 24:
+		b.add(cborTypePrimitives | v)
+	case v < 32:
+		b.SetError(errors.New("cbor: reserved simple value " + strconv.Itoa(int(v))))
+	default:
+		b.add(cborTypePrimitives|24, v)
+	}
+}
+
 func (b *Builder) AddArray(n uint64, fn BuilderContinuation) {
 	b.addUint64(cborTypeArray, n)
 	fn(b)
 }
 
+// AddArrayHeader appends only the head of an array of n items, which the
+// caller is then responsible for appending, exactly n of them, without the
+// continuation used by AddArray.
+func (b *Builder) AddArrayHeader(n uint64) {
+	b.addUint64(cborTypeArray, n)
+}
+
+// AddMapHeader appends only the head of a map of n items, which the caller
+// is then responsible for appending as exactly n key and value pairs.
+// Unlike those added with AddMapItem, the items are neither sorted nor
+// checked for duplicate keys, so they must be appended in the final order.
+func (b *Builder) AddMapHeader(n uint64) {
+	b.addUint64(cborTypeMap, n)
+}
+
+// AddBytesHeader appends only the head of a byte string of n bytes,
+// which the caller is then responsible for appending, exactly n of them,
+// for example with AddRawBytes.
+func (b *Builder) AddBytesHeader(n uint64) {
+	b.addUint64(cborTypeByteString, n)
+}
+
+// AddStringHeader appends only the head of a text string of n bytes,
+// which the caller is then responsible for appending, exactly n of them
+// and holding valid UTF-8, for example with AddRawBytes.
+func (b *Builder) AddStringHeader(n uint64) {
+	b.addUint64(cborTypeTextString, n)
+}
+
+// AddIntArray appends vs as an array of integers.
+// A nil vs is encoded as an empty array rather than null.
+func (b *Builder) AddIntArray(vs []int) {
+	b.addUint64(cborTypeArray, uint64(len(vs)))
+	for _, v := range vs {
+		b.AddInt(v)
+	}
+}
+
+// AddFloat64Array is like AddIntArray for floats,
+// which are encoded as specified by ModeFloat.
+func (b *Builder) AddFloat64Array(vs []float64) {
+	b.addUint64(cborTypeArray, uint64(len(vs)))
+	for _, v := range vs {
+		b.AddFloat64(v)
+	}
+}
+
+// AddComplex128Array is like AddIntArray for complex numbers, which are
+// laid out as specified by ModeComplexArray with each part encoded as
+// a float as specified by ModeFloat.
+func (b *Builder) AddComplex128Array(vs []complex128) {
+	if b.ModeComplexArray == ModeComplexArrayInterleaved {
+		b.addUint64(cborTypeArray, 2*uint64(len(vs)))
+		for _, v := range vs {
+			b.AddFloat64(real(v))
+			b.AddFloat64(imag(v))
+		}
+		return
+	}
+	b.addUint64(cborTypeArray, uint64(len(vs)))
+	for _, v := range vs {
+		b.addUint8(cborTypeArray, 2)
+		b.AddFloat64(real(v))
+		b.AddFloat64(imag(v))
+	}
+}
+
+// AddTypedArray appends vs as a little-endian typed array as defined by
+// RFC 8746, that is a byte string holding the packed elements wrapped in
+// the tag identifying the element type. vs must be a slice of uint8,
+// uint16, uint32, uint64, int8, int16, int32, int64, float32 or float64,
+// else an error is set.
+func (b *Builder) AddTypedArray(vs interface{}) {
+	le := binary.LittleEndian
+	switch vs := vs.(type) {
+	case []uint8:
+		b.AddTag(64)
+		if vs == nil {
+			// AddBytes would append null.
+			vs = []uint8{}
+		}
+		b.AddBytes(vs)
+	case []uint16:
+		addTypedArray(b, 69, 2, vs, le.PutUint16)
+	case []uint32:
+		addTypedArray(b, 70, 4, vs, le.PutUint32)
+	case []uint64:
+		addTypedArray(b, 71, 8, vs, le.PutUint64)
+	case []int8:
+		addTypedArray(b, 72, 1, vs, func(p []byte, v int8) { p[0] = byte(v) })
+	case []int16:
+		addTypedArray(b, 77, 2, vs, func(p []byte, v int16) { le.PutUint16(p, uint16(v)) })
+	case []int32:
+		addTypedArray(b, 78, 4, vs, func(p []byte, v int32) { le.PutUint32(p, uint32(v)) })
+	case []int64:
+		addTypedArray(b, 79, 8, vs, func(p []byte, v int64) { le.PutUint64(p, uint64(v)) })
+	case []float32:
+		addTypedArray(b, 85, 4, vs, func(p []byte, v float32) { le.PutUint32(p, math.Float32bits(v)) })
+	case []float64:
+		addTypedArray(b, 86, 8, vs, func(p []byte, v float64) { le.PutUint64(p, math.Float64bits(v)) })
+	case nil:
+		b.SetError(errors.New("cbor: unsupported typed array of type nil"))
+	default:
+		b.SetError(errors.New("cbor: unsupported typed array of type " + reflect.TypeOf(vs).String()))
+	}
+}
+
+// addTypedArray appends vs as a typed array with the given tag,
+// where put packs each element in size bytes.
+func addTypedArray[T any](b *Builder, tag uint64, size int, vs []T, put func([]byte, T)) {
+	b.AddTag(tag)
+	b.addUint64(cborTypeByteString, uint64(len(vs)*size))
+	var buf [8]byte
+	for _, v := range vs {
+		put(buf[:size], v)
+		b.add(buf[:size]...)
+	}
+}
+
+// AddDenseIntMap appends a map whose keys are the indices of values.
+// Nil elements denote absent keys and are not encoded. If no element is nil
+// and ModeDenseIntMap is ModeDenseIntMapArray, values are appended as
+// an array instead.
+func (b *Builder) AddDenseIntMap(values []interface{}) {
+	n := 0
+	for _, v := range values {
+		if v != nil {
+			n++
+		}
+	}
+	if n == len(values) && b.ModeDenseIntMap == ModeDenseIntMapArray {
+		b.AddArray(uint64(n), func(b *Builder) {
+			for _, v := range values {
+				b.Marshal(v)
+			}
+		})
+		return
+	}
+	b.AddMap(n)
+	for i, v := range values {
+		if v == nil {
+			continue
+		}
+		b.AddMapItem(func(b *Builder) {
+			b.AddInt(i)
+		}, func(b *Builder) {
+			b.Marshal(v)
+		})
+	}
+}
+
+// AddArrayUnknownLength appends an indefinite-length array whose items are
+// appended by fn. The closing break byte (0xff) is only appended if no error
+// has been set once fn returns, in which case the buffer is left as fn left it
+// and Bytes reports the error.
+func (b *Builder) AddArrayUnknownLength(fn BuilderContinuation) {
+	if !b.checkIndefinite() {
+		return
+	}
+	b.add(cborTypeArray | 31)
+	fn(b)
+	b.add(cborBreak)
+}
+
+// AddChannel drains the receive channel ch, which must be a channel value,
+// and appends the received elements as an array. At most max elements are
+// received if max is positive, else ch is drained until it is closed.
+// A nil channel is encoded as null.
+//
+// The elements buffered in ch when AddChannel is called are received first.
+// If they complete the array, because max is reached or ch is found closed
+// right after them, a definite-length array is appended. Otherwise
+// AddChannel blocks receiving from ch until max is reached or ch is closed,
+// appending the elements as they arrive inside an indefinite-length array,
+// or collecting them first to append a definite-length array if
+// ModeIndefinite is ModeIndefiniteForbid. Elements that are received are
+// consumed even if an error is set while encoding them.
+//
+// The returned error is the one reported by Bytes, if any.
+func (b *Builder) AddChannel(ch interface{}, max int) error {
+	if b.err != nil {
+		return b.err
+	}
+	if ch == nil {
+		b.SetError(errors.New("cbor: AddChannel of type nil"))
+		return b.err
+	}
+	v := reflect.ValueOf(ch)
+	if v.Kind() != reflect.Chan {
+		b.SetError(errors.New("cbor: AddChannel of non-channel type " + v.Type().String()))
+		return b.err
+	}
+	if v.Type().ChanDir()&reflect.RecvDir == 0 {
+		b.SetError(errors.New("cbor: AddChannel of send-only channel type " + v.Type().String()))
+		return b.err
+	}
+	if v.IsNil() {
+		b.AddNil()
+		return b.err
+	}
+	if !b.enter() {
+		return b.err
+	}
+	defer b.leave()
+	full := func(n int) bool { return max > 0 && n >= max }
+	n := v.Len()
+	if max > 0 && n > max {
+		n = max
+	}
+	vs := make([]reflect.Value, 0, n)
+	closed := false
+	for len(vs) < n {
+		x, ok := v.Recv()
+		if !ok {
+			closed = true
+			break
+		}
+		vs = append(vs, x)
+	}
+	if !closed && !full(len(vs)) {
+		// A zero Value means the receive would block,
+		// while a valid one with ok false means ch is closed.
+		x, ok := v.TryRecv()
+		if ok {
+			vs = append(vs, x)
+		} else if x.IsValid() {
+			closed = true
+		}
+	}
+	if !closed && !full(len(vs)) && b.ModeIndefinite != ModeIndefiniteForbid {
+		b.AddArrayUnknownLength(func(b *Builder) {
+			for _, x := range vs {
+				b.Marshal(x.Interface())
+			}
+			for n := len(vs); !full(n); n++ {
+				x, ok := v.Recv()
+				if !ok {
+					break
+				}
+				b.Marshal(x.Interface())
+			}
+		})
+		return b.err
+	}
+	for !closed && !full(len(vs)) {
+		x, ok := v.Recv()
+		if !ok {
+			break
+		}
+		vs = append(vs, x)
+	}
+	b.addUint64(cborTypeArray, uint64(len(vs)))
+	for _, x := range vs {
+		b.Marshal(x.Interface())
+	}
+	return b.err
+}
+
+// AddMapUnknownLength appends an indefinite-length map whose items are
+// appended by fn through the provided AddMapItemFunc. Items are encoded in
+// the order they are added, regardless of ModeSort. As for
+// AddArrayUnknownLength, the closing break byte is only appended if no
+// error has been set once fn returns.
+func (b *Builder) AddMapUnknownLength(fn func(AddMapItemFunc)) {
+	if !b.checkIndefinite() {
+		return
+	}
+	b.add(cborTypeMap | 31)
+	fn(func(k, v BuilderContinuation) {
+		k(b)
+		v(b)
+	})
+	b.add(cborBreak)
+}
+
+// checkIndefinite reports whether an indefinite-length item can be
+// appended, setting an error if ModeIndefinite forbids it.
+func (b *Builder) checkIndefinite() bool {
+	if b.ModeIndefinite == ModeIndefiniteForbid {
+		b.SetError(errors.New("cbor: indefinite-length items are forbidden"))
+		return false
+	}
+	return true
+}
+
 type AddMapItemFunc func(fnkey, fnvalue BuilderContinuation)
 
+// AddMap appends the head of a map with length items, which must then be
+// appended with AddMapItem. Items are sorted as they are added according to
+// ModeSort. With ModeSortNone they are encoded in the exact order they
+// were added.
 func (b *Builder) AddMap(length int) {
 	if length == 0 {
 		b.add(cborTypeMap)
@@ -846,78 +2355,166 @@ func (b *Builder) AddMap(length int) {
 	}
 	b.mapMaxSize = length
 	b.mapSize = 0
+	b.scopes++
 	b.addUint64(cborTypeMap, uint64(length))
-	if len(b.offsets) < length {
-		b.offsets = append(b.offsets, make([]mapItem, length-len(b.offsets))...)
+	if n := b.mapBase + length; len(b.offsets) < n {
+		b.offsets = append(b.offsets, make([]mapItem, n-len(b.offsets))...)
 	}
 }
 
+// AddMapItem appends an item to the map started by the last AddMap call,
+// with its key appended by k and its value by v.
 func (b *Builder) AddMapItem(k, v BuilderContinuation) {
 	if b.mapSize >= b.mapMaxSize {
 		panic("item does not fit in the map")
 	}
+	// Keys and values can contain maps themselves,
+	// so the state of the current map is restored once they are built.
+	base, size, maxSize := b.mapBase, b.mapSize, b.mapMaxSize
+	b.mapBase += b.mapMaxSize
 	offset := b.Len()
+	if b.ModeSort != ModeSortNone {
+		b.sortedItems++
+	}
 	k(b)
 	keyLength := b.Len() - offset
 	v(b)
-	b.offsets[b.mapSize] = mapItem{
+	if b.ModeSort != ModeSortNone {
+		b.sortedItems--
+	}
+	b.mapBase, b.mapSize, b.mapMaxSize = base, size, maxSize
+	b.offsets[b.mapBase+b.mapSize] = mapItem{
 		offset:    offset,
 		keyLength: keyLength,
 	}
 	b.mapSize++
+	if b.DetectDuplicateKeys {
+		b.checkDuplicateKey()
+	}
 	if b.ModeSort != ModeSortNone {
 		b.sort()
 	}
+	if b.mapSize == b.mapMaxSize {
+		b.scopes--
+	}
+}
+
+// AddRawMapEntry appends an item to the map started by the last AddMap call
+// from the encoded key and value, which must each be a single well-formed
+// data item. The item is sorted and checked for duplicate keys like the
+// ones added by AddMapItem, so maps can be built from precomputed bytes.
+func (b *Builder) AddRawMapEntry(key, value []byte) {
+	b.AddMapItem(func(b *Builder) {
+		b.AddRawBytes(key)
+	}, func(b *Builder) {
+		b.AddRawBytes(value)
+	})
+}
+
+// checkDuplicateKey sets an error if the key of the last item
+// added to the current map is equal to the key of a previous item.
+func (b *Builder) checkDuplicateKey() {
+	items := b.offsets[b.mapBase : b.mapBase+b.mapSize]
+	last := items[len(items)-1]
+	key := b.result[last.offset : last.offset+last.keyLength]
+	for _, mi := range items[:len(items)-1] {
+		if bytes.Equal(key, b.result[mi.offset:mi.offset+mi.keyLength]) {
+			b.SetError(errors.New("cbor: duplicate map key"))
+			return
+		}
+	}
 }
 
 func (b *Builder) AddTag(number uint64) {
 	b.addUint64(cborTypeTag, number)
 }
 
+// AddSelfDescribeTag appends the self-described CBOR tag 55799 (0xd9d9f7),
+// which must be followed by the tagged value.
+func (b *Builder) AddSelfDescribeTag() {
+	b.described = true
+	b.AddTag(55799)
+}
+
+// compareIntKeys compares the encoded keys x and y by numeric value,
+// reporting false if either of them is not an integer.
+func compareIntKeys(x, y []byte) (int, bool) {
+	mx, nx, sx, err := readHead(x)
+	if err != nil || sx != len(x) || mx > cborTypeNegativeInt {
+		return 0, false
+	}
+	my, ny, sy, err := readHead(y)
+	if err != nil || sy != len(y) || my > cborTypeNegativeInt {
+		return 0, false
+	}
+	switch {
+	case mx != my:
+		// Negative integers sort before positive ones.
+		if mx == cborTypeNegativeInt {
+			return -1, true
+		}
+		return 1, true
+	case nx == ny:
+		return 0, true
+	case (nx < ny) == (mx == cborTypePositiveInt):
+		return -1, true
+	}
+	return 1, true
+}
+
 type mapItem struct {
 	offset    int
 	keyLength int
 }
 
 func (b *Builder) sort() {
+	items := b.offsets[b.mapBase : b.mapBase+b.mapSize]
 	keyFn := func(i int) []byte {
-		mi := b.offsets[i]
+		mi := items[i]
 		return b.result[mi.offset : mi.offset+mi.keyLength]
 	}
 	itemFn := func(i int) []byte {
-		mi := b.offsets[i]
+		mi := items[i]
 		max := len(b.result)
-		if i < b.mapSize-1 {
-			max = b.offsets[i+1].offset
+		if i < len(items)-1 {
+			max = items[i+1].offset
 		}
 		return b.result[mi.offset:max]
 	}
-	x := keyFn(b.mapSize - 1)
-	idx := sort.Search(b.mapSize-1, func(i int) bool {
+	n := len(items) - 1
+	x := keyFn(n)
+	idx := sort.Search(n, func(i int) bool {
 		y := keyFn(i)
-		if b.ModeSort == ModeSortLengthFirst && len(x) != len(y) {
-			return len(x) < len(y)
+		switch b.ModeSort {
+		case ModeSortLengthFirst:
+			if len(x) != len(y) {
+				return len(x) < len(y)
+			}
+		case ModeSortNumeric:
+			if c, ok := compareIntKeys(x, y); ok {
+				return c <= 0
+			}
 		}
 		return bytes.Compare(x, y) <= 0
 	})
-	if idx < b.mapSize-1 {
-		last := itemFn(b.mapSize - 1)
+	if idx < n {
+		last := itemFn(n)
 		if len(b.tmp) < len(last) {
 			b.tmp = append(b.tmp, make([]byte, len(last)-len(b.tmp))...)
 		}
-		newOffset := b.offsets[idx].offset
+		newOffset := items[idx].offset
 		copy(b.tmp, last)
 		copy(b.result[newOffset+len(last):], b.result[newOffset:])
 		copy(b.result[newOffset:], b.tmp[:len(last)])
-		lastOffset := b.offsets[b.mapSize-1]
-		for i := b.mapSize - 1; i > idx; i-- {
-			prev := b.offsets[i-1]
-			b.offsets[i] = mapItem{
+		lastOffset := items[n]
+		for i := n; i > idx; i-- {
+			prev := items[i-1]
+			items[i] = mapItem{
 				offset:    prev.offset + len(last),
 				keyLength: prev.keyLength,
 			}
 		}
 		lastOffset.offset = newOffset
-		b.offsets[idx] = lastOffset
+		items[idx] = lastOffset
 	}
 }
@@ -2,11 +2,23 @@ package cbor
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
 	"math"
 	"math/big"
+	"net"
+	"net/netip"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/x448/float16"
 )
 
 type marshalTest struct {
@@ -294,6 +306,42 @@ var exMarshalTests = []marshalTest{
 			[]interface{}{nil, nil, nil},
 		},
 	},
+	{
+		// struct with unexported field
+		hexDecode("820102"),
+		[]interface{}{
+			inner{X: 1, Y: 2, z: 3},
+			&inner{X: 1, Y: 2, z: 3},
+		},
+	},
+	{
+		// struct with unexported field and nested struct pointer
+		hexDecode("8801f93e00f56161410181617aa16174f5820102"),
+		[]interface{}{
+			outer{
+				IntField:          1,
+				FloatField:        1.5,
+				BoolField:         true,
+				StringField:       "a",
+				ByteStringField:   []byte{1},
+				ArrayField:        []string{"z"},
+				MapField:          map[string]bool{"t": true},
+				NestedStructField: &inner{X: 1, Y: 2, z: 3},
+				unexportedField:   4,
+			},
+		},
+	},
+	{
+		// struct with blank field
+		hexDecode("820102"),
+		[]interface{}{
+			struct {
+				A int
+				_ int
+				B int
+			}{A: 1, B: 2},
+		},
+	},
 }
 
 func TestMarshal(t *testing.T) {
@@ -318,3 +366,3611 @@ func testMarshal(t *testing.T, testCases []marshalTest) {
 		}
 	}
 }
+
+func TestEncodedSize(t *testing.T) {
+	for _, tc := range append(marshalTests, exMarshalTests...) {
+		for _, value := range tc.values {
+			if n, err := EncodedSize(value); err != nil {
+				t.Errorf("EncodedSize(%v) returned error %v", value, err)
+			} else if n != len(tc.cborData) {
+				t.Errorf("EncodedSize(%v) = %d, want %d", value, n, len(tc.cborData))
+			}
+		}
+	}
+}
+
+func TestBuilderEncodedSize(t *testing.T) {
+	m := map[string]interface{}{"bb": 1.5, "a": []float64{1, 2.5}, "ccc": map[int]string{3: "c", 1: "a"}}
+	tests := []struct {
+		name string
+		b    *Builder
+	}{
+		{"default", &Builder{}},
+		{"float none", &Builder{ModeFloat: ModeFloatNone}},
+		{"fixed int width", &Builder{ModeIntWidth: ModeIntWidthFixed64}},
+		{"self-describe", &Builder{SelfDescribe: true}},
+		{"core deterministic", CoreDeterministic()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := tt.b.EncodedSize(m)
+			if err != nil {
+				t.Fatalf("EncodedSize() returned error %v", err)
+			}
+			if tt.b.Len() != 0 {
+				t.Errorf("EncodedSize() wrote %d bytes to the builder", tt.b.Len())
+			}
+			tt.b.Marshal(m)
+			data, err := tt.b.Bytes()
+			if err != nil {
+				t.Fatalf("Marshal() returned error %v", err)
+			}
+			if n != len(data) {
+				t.Errorf("EncodedSize() = %d, want %d", n, len(data))
+			}
+		})
+	}
+}
+
+func TestBuilderEncodedSizeShared(t *testing.T) {
+	type point struct {
+		X int
+	}
+	p, q := &point{1}, &point{2}
+	b := Builder{ModeShare: ModeSharePointers}
+	b.Marshal([]interface{}{p, p})
+	n, err := b.EncodedSize([]interface{}{q, q})
+	if err != nil {
+		t.Fatalf("EncodedSize() returned error %v", err)
+	}
+	// The pointers marked while sizing are not marked in b.
+	b.Marshal([]interface{}{q, q})
+	data, err := b.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := hexDecode("82d81c8101d81d00" + "82d81c8102d81d01")
+	if !bytes.Equal(data, want) {
+		t.Errorf("Bytes() = 0x%x, want 0x%x", data, want)
+	}
+	if second := len(want) / 2; n != second {
+		t.Errorf("EncodedSize() = %d, want %d", n, second)
+	}
+}
+
+func TestBuilderEncodedSizeMaxSize(t *testing.T) {
+	b := Builder{MaxSize: 5}
+	b.AddString("ab")
+	if n, err := b.EncodedSize("c"); err != nil || n != 2 {
+		t.Errorf("EncodedSize() = %d, %v, want 2, nil", n, err)
+	}
+	// The 3 bytes already written count towards MaxSize.
+	if n, err := b.EncodedSize("cd"); err == nil {
+		t.Errorf("EncodedSize() = %d, want error", n)
+	}
+	b.Marshal("cd")
+	if _, err := b.Bytes(); err == nil {
+		t.Error("Marshal() did not exceed MaxSize")
+	}
+}
+
+func TestEncodedSizeError(t *testing.T) {
+	if n, err := EncodedSize(make(chan int)); err == nil {
+		t.Errorf("EncodedSize() = %d, want error", n)
+	}
+}
+
+func TestMarshalBigIntSlice(t *testing.T) {
+	big1 := bigIntOrPanic("18446744073709551616")
+	bigm1 := bigIntOrPanic("-18446744073709551617")
+	want := hexDecode("8500182020c249010000000000000000c349010000000000000000")
+	values := []interface{}{
+		[]big.Int{*big.NewInt(0), *big.NewInt(32), *big.NewInt(-1), big1, bigm1},
+		[]*big.Int{big.NewInt(0), big.NewInt(32), big.NewInt(-1), &big1, &bigm1},
+	}
+	for _, value := range values {
+		if b, err := Marshal(value); err != nil {
+			t.Errorf("Marshal(%v) returned error %v", value, err)
+		} else if !bytes.Equal(b, want) {
+			t.Errorf("Marshal(%v) = 0x%x, want 0x%x", value, b, want)
+		}
+	}
+	if b, err := Marshal([]*big.Int{nil, big.NewInt(1)}); err != nil {
+		t.Errorf("Marshal() returned error %v", err)
+	} else if want := hexDecode("82f601"); !bytes.Equal(b, want) {
+		t.Errorf("Marshal() = 0x%x, want 0x%x", b, want)
+	}
+}
+
+func BenchmarkMarshalBigIntSlice(b *testing.B) {
+	v := make([]*big.Int, 10000)
+	for i := range v {
+		v[i] = new(big.Int).Lsh(big.NewInt(int64(i)-5000), uint(i%100))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Marshal(v); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestModeEmptyString(t *testing.T) {
+	type s struct {
+		A string
+		B string
+	}
+	tests := []struct {
+		mode ModeEmptyString
+		v    interface{}
+		want []byte
+	}{
+		{ModeEmptyStringText, "", hexDecode("60")},
+		{ModeEmptyStringNull, "", hexDecode("f6")},
+		{ModeEmptyStringText, "a", hexDecode("6161")},
+		{ModeEmptyStringNull, "a", hexDecode("6161")},
+		{ModeEmptyStringText, s{B: "b"}, hexDecode("82606162")},
+		{ModeEmptyStringNull, s{B: "b"}, hexDecode("82f66162")},
+	}
+	for _, tt := range tests {
+		b := Builder{ModeEmptyString: tt.mode}
+		b.Marshal(tt.v)
+		if got, err := b.Bytes(); err != nil {
+			t.Errorf("Marshal(%v) returned error %v", tt.v, err)
+		} else if !bytes.Equal(got, tt.want) {
+			t.Errorf("Marshal(%v) = 0x%x, want 0x%x", tt.v, got, tt.want)
+		}
+	}
+}
+
+func nestedSlice(depth int) interface{} {
+	var v interface{} = []interface{}{}
+	for i := 1; i < depth; i++ {
+		v = []interface{}{v}
+	}
+	return v
+}
+
+func nestedMap(depth int) interface{} {
+	var v interface{} = 1
+	for i := 0; i < depth; i++ {
+		v = map[string]interface{}{"a": v}
+	}
+	return v
+}
+
+func TestMaxNestingDepth(t *testing.T) {
+	type node struct {
+		Next *node
+	}
+	cyclicSlice := []interface{}{nil}
+	cyclicSlice[0] = cyclicSlice
+	cyclicStruct := &node{}
+	cyclicStruct.Next = cyclicStruct
+	tests := []struct {
+		name    string
+		v       interface{}
+		wantErr bool
+	}{
+		{"deep", nestedSlice(50), false},
+		{"too deep", nestedSlice(51), true},
+		{"cyclic slice", cyclicSlice, true},
+		{"cyclic struct", cyclicStruct, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := Builder{MaxNestingDepth: 50}
+			b.Marshal(tt.v)
+			_, err := b.Bytes()
+			if tt.wantErr {
+				if err == nil || err.Error() != "cbor: exceeded max nesting depth" {
+					t.Errorf("Marshal() returned error %v, want max nesting depth error", err)
+				}
+			} else if err != nil {
+				t.Errorf("Marshal() returned error %v", err)
+			}
+		})
+	}
+}
+
+func TestOverflows(t *testing.T) {
+	tests := []struct {
+		n, m, max int
+		want      bool
+	}{
+		{0, 0, 0, false},
+		{10, 5, 0, false},
+		{math.MaxInt - 5, 5, 0, false},
+		{math.MaxInt - 5, 6, 0, true},
+		{math.MaxInt, 1, 0, true},
+		{1, math.MaxInt, 0, true},
+		{math.MaxInt, math.MaxInt, 0, true},
+		{5, 5, 10, false},
+		{5, 6, 10, true},
+		{0, 11, 10, true},
+	}
+	for _, tt := range tests {
+		if got := overflows(tt.n, tt.m, tt.max); got != tt.want {
+			t.Errorf("overflows(%d, %d, %d) = %v, want %v", tt.n, tt.m, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		max     int
+		v       interface{}
+		want    []byte
+		wantErr bool
+	}{
+		{"fits", 4, []int{1, 2, 3}, hexDecode("83010203"), false},
+		{"too large", 3, []int{1, 2, 3}, hexDecode("830102"), true},
+		{"string", 3, "abc", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := Builder{MaxSize: tt.max}
+			b.Marshal(tt.v)
+			got, err := b.Bytes()
+			if tt.wantErr {
+				if err == nil || err.Error() != "cbor: encoding exceeds MaxSize ("+strconv.Itoa(tt.max)+")" {
+					t.Errorf("Marshal() returned error %v, want MaxSize error", err)
+				}
+				if want := tt.want; want != nil && !bytes.Equal(b.result, want) {
+					t.Errorf("buffer = 0x%x, want 0x%x", b.result, want)
+				}
+			} else if err != nil {
+				t.Errorf("Marshal() returned error %v", err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Errorf("Marshal() = 0x%x, want 0x%x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaxSizeFlushed(t *testing.T) {
+	var out []byte
+	b := Builder{MaxSize: 4}
+	b.SetFlushThreshold(1, func(p []byte) error {
+		out = append(out, p...)
+		return nil
+	})
+	b.Marshal([]int{1, 2, 3})
+	b.Marshal(4)
+	if err := b.Flush(); err == nil {
+		t.Errorf("Flush() returned no error, want MaxSize error")
+	}
+	if want := hexDecode("83010203"); !bytes.Equal(out, want) {
+		t.Errorf("flushed 0x%x, want 0x%x", out, want)
+	}
+}
+
+func TestModeSharePointers(t *testing.T) {
+	type point struct {
+		X int
+	}
+	type node struct {
+		Next *node
+	}
+	type pair struct {
+		A *point `cbor:"a"`
+		B *point `cbor:"b"`
+	}
+	p, q := &point{1}, &point{2}
+	cyclic := &node{}
+	cyclic.Next = cyclic
+	share := Builder{ModeShare: ModeSharePointers}
+	tests := []struct {
+		name string
+		b    Builder
+		v    interface{}
+		want []byte
+	}{
+		{"none", Builder{}, []interface{}{p, p}, hexDecode("8281018101")},
+		{"shared", share, []interface{}{p, p, p}, hexDecode("83d81c8101d81d00d81d00")},
+		{"two shared", share, []*point{p, q, q, p}, hexDecode("84d81c8101d81c8102d81d01d81d00")},
+		{"not shared", share, []interface{}{p, q}, hexDecode("8281018102")},
+		{"cyclic", share, cyclic, hexDecode("d81c81d81d00")},
+		{"sorted map", share, pair{p, p}, hexDecode("a2616181016162" + "8101")},
+		{"unsorted map", Builder{ModeShare: ModeSharePointers, ModeSort: ModeSortNone}, pair{p, p}, hexDecode("a26161d81c81016162d81d00")},
+		{"reference in sorted map", share, []interface{}{p, map[string]*point{"a": p}}, hexDecode("82d81c8101a16161d81d00")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.b
+			b.Marshal(tt.v)
+			if got, err := b.Bytes(); err != nil {
+				t.Errorf("Marshal() returned error %v", err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Errorf("Marshal() = 0x%x, want 0x%x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestModeSharePointersSequence(t *testing.T) {
+	p := &struct{ X int }{1}
+	b := Builder{ModeShare: ModeSharePointers}
+	b.AddSequenceItem([]interface{}{p, p})
+	b.AddSequenceItem([]interface{}{p, p})
+	want := hexDecode("82d81c8101d81d00" + "82d81c8101d81d00")
+	if got, err := b.Bytes(); err != nil {
+		t.Errorf("AddSequenceItem() returned error %v", err)
+	} else if !bytes.Equal(got, want) {
+		t.Errorf("AddSequenceItem() = 0x%x, want 0x%x", got, want)
+	}
+}
+
+func TestMarshalGoArray(t *testing.T) {
+	one := 1
+	tests := []struct {
+		v    interface{}
+		want []byte
+	}{
+		{[0]int{}, hexDecode("80")},
+		{[3]int{1, 2, 3}, hexDecode("83010203")},
+		{[2][3]int{{1, 2, 3}, {4, 5, 6}}, hexDecode("828301020383040506")},
+		{[2][0]int{}, hexDecode("828080")},
+		{[2]*int{&one, nil}, hexDecode("8201f6")},
+		{[2]interface{}{"a", [1]int{1}}, hexDecode("8261618101")},
+		// Byte arrays are still encoded as byte strings, at any level.
+		{[0]byte{}, hexDecode("40")},
+		{[2][2]byte{{1, 2}, {3, 4}}, hexDecode("82420102420304")},
+	}
+	for _, tt := range tests {
+		if b, err := Marshal(tt.v); err != nil {
+			t.Errorf("Marshal(%v) returned error %v", tt.v, err)
+		} else if !bytes.Equal(b, tt.want) {
+			t.Errorf("Marshal(%v) = 0x%x, want 0x%x", tt.v, b, tt.want)
+		}
+	}
+}
+
+func TestAddArrayUnknownLength(t *testing.T) {
+	var b Builder
+	b.AddArrayUnknownLength(func(b *Builder) {
+		b.AddInt(1)
+		b.AddArray(2, func(b *Builder) {
+			b.AddInt(2)
+			b.AddInt(3)
+		})
+		b.AddArrayUnknownLength(func(b *Builder) {
+			b.AddInt(4)
+			b.AddInt(5)
+		})
+	})
+	want := hexDecode("9f018202039f0405ffff")
+	if got, err := b.Bytes(); err != nil {
+		t.Errorf("AddArrayUnknownLength() returned error %v", err)
+	} else if !bytes.Equal(got, want) {
+		t.Errorf("AddArrayUnknownLength() = 0x%x, want 0x%x", got, want)
+	}
+}
+
+func TestAddArrayUnknownLengthError(t *testing.T) {
+	var b Builder
+	wantErr := errors.New("test error")
+	b.AddArrayUnknownLength(func(b *Builder) {
+		b.AddInt(1)
+		b.SetError(wantErr)
+		b.AddInt(2)
+	})
+	if got, err := b.Bytes(); err != wantErr {
+		t.Errorf("Bytes() returned error %v, want %v", err, wantErr)
+	} else if got != nil {
+		t.Errorf("Bytes() = 0x%x, want nil", got)
+	}
+	if want := hexDecode("9f01"); !bytes.Equal(b.result, want) {
+		t.Errorf("buffer = 0x%x, want 0x%x", b.result, want)
+	}
+}
+
+func TestAddChannel(t *testing.T) {
+	buffered := func(closed bool, vs ...int) chan int {
+		ch := make(chan int, 4)
+		for _, v := range vs {
+			ch <- v
+		}
+		if closed {
+			close(ch)
+		}
+		return ch
+	}
+	tests := []struct {
+		name string
+		b    Builder
+		ch   interface{}
+		max  int
+		want []byte
+		left int
+	}{
+		{"closed", Builder{}, buffered(true, 1, 2, 3), 0, hexDecode("83010203"), 0},
+		{"closed empty", Builder{}, buffered(true), 0, hexDecode("80"), 0},
+		{"max", Builder{}, buffered(false, 1, 2, 3), 2, hexDecode("820102"), 1},
+		{"max reached", Builder{}, buffered(false, 1, 2), 2, hexDecode("820102"), 0},
+		{"closed before max", Builder{}, buffered(true, 1, 2), 3, hexDecode("820102"), 0},
+		{"receive-only", Builder{}, (<-chan int)(buffered(true, 1)), 0, hexDecode("8101"), 0},
+		{"nil", Builder{}, (chan int)(nil), 0, hexDecode("f6"), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.b
+			if err := b.AddChannel(tt.ch, tt.max); err != nil {
+				t.Fatalf("AddChannel() returned error %v", err)
+			}
+			if got, _ := b.Bytes(); !bytes.Equal(got, tt.want) {
+				t.Errorf("AddChannel() = 0x%x, want 0x%x", got, tt.want)
+			}
+			if ch, ok := tt.ch.(chan int); ok && len(ch) != tt.left {
+				t.Errorf("AddChannel() left %d elements, want %d", len(ch), tt.left)
+			}
+		})
+	}
+}
+
+func TestAddChannelBlocking(t *testing.T) {
+	tests := []struct {
+		name string
+		b    Builder
+		max  int
+		want []byte
+	}{
+		{"indefinite", Builder{}, 0, hexDecode("9f010203ff")},
+		{"indefinite max", Builder{}, 2, hexDecode("9f0102ff")},
+		{"forbid indefinite", Builder{ModeIndefinite: ModeIndefiniteForbid}, 0, hexDecode("83010203")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := make(chan int)
+			go func() {
+				defer close(ch)
+				for i := 1; i <= 3; i++ {
+					select {
+					case ch <- i:
+					case <-time.After(time.Second):
+						return
+					}
+				}
+			}()
+			b := tt.b
+			if err := b.AddChannel(ch, tt.max); err != nil {
+				t.Fatalf("AddChannel() returned error %v", err)
+			}
+			if got, _ := b.Bytes(); !bytes.Equal(got, tt.want) {
+				t.Errorf("AddChannel() = 0x%x, want 0x%x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddChannelError(t *testing.T) {
+	tests := []struct {
+		name string
+		ch   interface{}
+		want string
+	}{
+		{"nil", nil, "cbor: AddChannel of type nil"},
+		{"slice", []int{1}, "cbor: AddChannel of non-channel type []int"},
+		{"send-only", (chan<- int)(make(chan int)), "cbor: AddChannel of send-only channel type chan<- int"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b Builder
+			if err := b.AddChannel(tt.ch, 0); err == nil || err.Error() != tt.want {
+				t.Errorf("AddChannel() returned error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddMapUnknownLength(t *testing.T) {
+	var b Builder
+	b.AddMapUnknownLength(func(add AddMapItemFunc) {
+		add(func(b *Builder) {
+			b.AddString("a")
+		}, func(b *Builder) {
+			b.AddInt(1)
+		})
+		add(func(b *Builder) {
+			b.AddString("b")
+		}, func(b *Builder) {
+			b.AddArrayUnknownLength(func(b *Builder) {
+				b.AddInt(2)
+				b.AddInt(3)
+			})
+		})
+	})
+	// {_ "a": 1, "b": [_ 2, 3]}, from RFC 8949 appendix A.
+	want := hexDecode("bf61610161629f0203ffff")
+	if got, err := b.Bytes(); err != nil {
+		t.Errorf("AddMapUnknownLength() returned error %v", err)
+	} else if !bytes.Equal(got, want) {
+		t.Errorf("AddMapUnknownLength() = 0x%x, want 0x%x", got, want)
+	}
+}
+
+func TestModeIndefiniteForbid(t *testing.T) {
+	tests := []struct {
+		name string
+		fn   BuilderContinuation
+	}{
+		{"array", func(b *Builder) {
+			b.AddArrayUnknownLength(func(b *Builder) {})
+		}},
+		{"map", func(b *Builder) {
+			b.AddMapUnknownLength(func(AddMapItemFunc) {})
+		}},
+		{"text string", func(b *Builder) {
+			b.AddStringIndefinite(func(b *Builder) {})
+		}},
+		{"byte string", func(b *Builder) {
+			b.AddBytesIndefinite(func(b *Builder) {})
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := Builder{ModeIndefinite: ModeIndefiniteForbid}
+			tt.fn(&b)
+			if _, err := b.Bytes(); err == nil {
+				t.Error("Bytes() returned no error")
+			}
+			if len(b.result) != 0 {
+				t.Errorf("buffer = 0x%x, want empty", b.result)
+			}
+		})
+	}
+}
+
+func TestMarshalStructAsMap(t *testing.T) {
+	type renamed struct {
+		Alpha int `cbor:"a"`
+		Beta  int `cbor:"bb"`
+	}
+	type mixed struct {
+		Long  int `cbor:"zz"`
+		B     int
+		Inner map[string]int
+	}
+	tests := []struct {
+		name string
+		b    Builder
+		v    interface{}
+		want []byte
+	}{
+		{"renamed", Builder{}, renamed{1, 2}, hexDecode("a261610162626202")},
+		{"mixed", Builder{}, mixed{1, 2, map[string]int{"y": 3, "x": 4}}, hexDecode("a3614202627a7a0165496e6e6572a2617804617903")},
+		{"mixed length first", Builder{ModeSort: ModeSortLengthFirst}, mixed{1, 2, nil}, hexDecode("a3614202627a7a0165496e6e6572f6")},
+		{"mixed bytewise", Builder{ModeSort: ModeSortBytewiseLexical}, mixed{1, 2, nil}, hexDecode("a3614202627a7a0165496e6e6572f6")},
+		{"mixed unsorted", Builder{ModeSort: ModeSortNone}, mixed{1, 2, nil}, hexDecode("a3627a7a0161420265496e6e6572f6")},
+		{"untagged", Builder{}, inner{1, 2, 3}, hexDecode("820102")},
+		{"untagged as map", Builder{StructAsMap: true}, inner{1, 2, 3}, hexDecode("a2615801615902")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.b
+			b.Marshal(tt.v)
+			if got, err := b.Bytes(); err != nil {
+				t.Errorf("Marshal(%v) returned error %v", tt.v, err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Errorf("Marshal(%v) = 0x%x, want 0x%x", tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarshalNestedMaps(t *testing.T) {
+	v := map[string]map[string]int{
+		"b": {"y": 1, "x": 2},
+		"a": {"z": 3},
+	}
+	want := hexDecode("a26161a1617a036162a2617802617901")
+	if b, err := Marshal(v); err != nil {
+		t.Errorf("Marshal(%v) returned error %v", v, err)
+	} else if !bytes.Equal(b, want) {
+		t.Errorf("Marshal(%v) = 0x%x, want 0x%x", v, b, want)
+	}
+}
+
+func TestMarshalOmitEmpty(t *testing.T) {
+	type s struct {
+		A string `cbor:"a,omitempty"`
+		B int    `cbor:"b,omitempty"`
+		C []int  `cbor:"c,omitempty"`
+		D *int   `cbor:"d,omitempty"`
+		E bool   `cbor:"e"`
+	}
+	zero := 0
+	tests := []struct {
+		name string
+		v    s
+		want []byte
+	}{
+		{"all empty", s{}, hexDecode("a16165f4")},
+		{"none empty", s{A: "x", B: 1, C: []int{2}, D: &zero, E: true}, hexDecode("a561616178616201616381026164006165f5")},
+		{"some empty", s{B: 1, C: []int{}}, hexDecode("a26162016165f4")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := Marshal(tt.v); err != nil {
+				t.Errorf("Marshal(%v) returned error %v", tt.v, err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Errorf("Marshal(%v) = 0x%x, want 0x%x", tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarshalOmitEmptyPresence(t *testing.T) {
+	type s struct {
+		A *int       `cbor:"a,omitempty"`
+		B *string    `cbor:"b,omitzero"`
+		C *time.Time `cbor:"c,omitzero"`
+		D **int      `cbor:"d,omitempty"`
+	}
+	zero, empty := 0, ""
+	var nilInt *int
+	tests := []struct {
+		name string
+		v    s
+		want []byte
+	}{
+		{"absent", s{}, hexDecode("a0")},
+		{"zero int", s{A: &zero}, hexDecode("a1616100")},
+		{"empty string", s{B: &empty}, hexDecode("a1616260")},
+		{"zero time", s{C: &time.Time{}}, hexDecode("a16163c074303030312d30312d30315430303a30303a30305a")},
+		{"pointer to nil", s{D: &nilInt}, hexDecode("a16164f6")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Marshal(tt.v)
+			if err != nil {
+				t.Fatalf("Marshal(%v) returned error %v", tt.v, err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("Marshal(%v) = 0x%x, want 0x%x", tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarshalOmitEmptyPresenceRoundTrip(t *testing.T) {
+	type s struct {
+		A *int `cbor:"a,omitempty"`
+		B *int `cbor:"b,omitempty"`
+	}
+	zero := 0
+	data, err := Marshal(s{B: &zero})
+	if err != nil {
+		t.Fatalf("Marshal() returned error %v", err)
+	}
+	var got s
+	if err := Unmarshal(data, &got); err != nil {
+		t.Fatalf("Unmarshal(0x%x) returned error %v", data, err)
+	}
+	if got.A != nil {
+		t.Errorf("Unmarshal(0x%x) A = %d, want nil", data, *got.A)
+	}
+	if got.B == nil || *got.B != 0 {
+		t.Errorf("Unmarshal(0x%x) B = %v, want pointer to 0", data, got.B)
+	}
+}
+
+func TestMarshalOmitEmptyMapHeader(t *testing.T) {
+	type s struct {
+		S   string         `cbor:"s,omitempty"`
+		I   int            `cbor:"i,omitempty"`
+		U   uint           `cbor:"u,omitempty"`
+		F   float64        `cbor:"f,omitempty"`
+		B   bool           `cbor:"b,omitempty"`
+		Sl  []int          `cbor:"sl,omitempty"`
+		M   map[string]int `cbor:"m,omitempty"`
+		P   *int           `cbor:"p,omitempty"`
+		A   [0]int         `cbor:"a,omitempty"`
+		Any interface{}    `cbor:"any,omitempty"`
+		Z   int            `cbor:"z"`
+	}
+	one := 1
+	tests := []struct {
+		v    s
+		want byte
+	}{
+		{s{}, 0xa1},
+		{s{S: "x", I: -1, U: 1, F: 1.5, B: true, Sl: []int{1}, M: map[string]int{"k": 1}, P: &one, Any: 0}, 0xaa},
+		{s{I: 2, Sl: []int{}, M: map[string]int{}}, 0xa2},
+	}
+	for _, tt := range tests {
+		got, err := Marshal(tt.v)
+		if err != nil {
+			t.Errorf("Marshal(%v) returned error %v", tt.v, err)
+			continue
+		}
+		if got[0] != tt.want {
+			t.Errorf("Marshal(%v) map header = 0x%x, want 0x%x", tt.v, got[0], tt.want)
+		}
+	}
+}
+
+func TestMarshalMapNilValues(t *testing.T) {
+	want := hexDecode("a56161f66162f66163f66164f66165f6")
+	values := []interface{}{
+		map[interface{}]interface{}{
+			"a": nil,
+			"b": (*int)(nil),
+			"c": (*inner)(nil),
+			"d": []int(nil),
+			"e": map[string]int(nil),
+		},
+		map[string]interface{}{
+			"a": nil,
+			"b": (*int)(nil),
+			"c": (*inner)(nil),
+			"d": []int(nil),
+			"e": map[string]int(nil),
+		},
+	}
+	for _, v := range values {
+		if b, err := Marshal(v); err != nil {
+			t.Errorf("Marshal(%v) returned error %v", v, err)
+		} else if !bytes.Equal(b, want) {
+			t.Errorf("Marshal(%v) = 0x%x, want 0x%x", v, b, want)
+		}
+	}
+}
+
+func TestCanEncodeDeterministic(t *testing.T) {
+	tests := []struct {
+		name    string
+		v       interface{}
+		wantErr string
+	}{
+		{"clean", map[interface{}]interface{}{"a": 1, 2: []interface{}{math.NaN(), 1.5}}, ""},
+		{"duplicate keys", map[interface{}]interface{}{uint64(1): "a", int(1): "b"}, "cbor: duplicate map key"},
+		{"nested duplicate keys", []interface{}{map[interface{}]interface{}{"a": 0, "b": map[interface{}]interface{}{int8(3): 0, uint16(3): 0}}}, "cbor: duplicate map key"},
+		{"unsupported type", make(chan int), "cbor: invalid type"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CanEncodeDeterministic(tt.v)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("CanEncodeDeterministic() returned error %v", err)
+				}
+			} else if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+				t.Errorf("CanEncodeDeterministic() returned error %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMarshalExcludedField(t *testing.T) {
+	type s struct {
+		A      int
+		Secret string `cbor:"-"`
+		B      int
+	}
+	type dash struct {
+		D int `cbor:"-,"`
+	}
+	tests := []struct {
+		name string
+		b    Builder
+		v    interface{}
+		want []byte
+	}{
+		{"array", Builder{}, s{1, "secret", 2}, hexDecode("820102")},
+		{"map", Builder{StructAsMap: true}, s{1, "secret", 2}, hexDecode("a2614101614202")},
+		{"dash name", Builder{}, dash{1}, hexDecode("a1612d01")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.b
+			b.Marshal(tt.v)
+			if got, err := b.Bytes(); err != nil {
+				t.Errorf("Marshal(%v) returned error %v", tt.v, err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Errorf("Marshal(%v) = 0x%x, want 0x%x", tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarshalKeyAsInt(t *testing.T) {
+	type coseHeader struct {
+		Kid []byte `cbor:"4,keyasint,omitempty"`
+		Alg int    `cbor:"1,keyasint,omitempty"`
+	}
+	type coseKey struct {
+		Crv int    `cbor:"-1,keyasint"`
+		Kty int    `cbor:"1,keyasint"`
+		X   []byte `cbor:"-2,keyasint"`
+		Kid string `cbor:"kid"`
+	}
+	tests := []struct {
+		name string
+		b    Builder
+		v    interface{}
+		want []byte
+	}{
+		// {1: -7, 4: h'0102'}
+		{"cose header", Builder{}, coseHeader{Alg: -7, Kid: []byte{1, 2}}, hexDecode("a2012604420102")},
+		{"cose header unsorted", Builder{ModeSort: ModeSortNone}, coseHeader{Alg: -7, Kid: []byte{1, 2}}, hexDecode("a2044201020126")},
+		{"cose header omitempty", Builder{}, coseHeader{Alg: -7}, hexDecode("a10126")},
+		// {1: 2, -1: 1, -2: h'03', "kid": "a"}
+		{"negative keys", Builder{}, coseKey{Crv: 1, Kty: 2, X: []byte{3}, Kid: "a"}, hexDecode("a401022001214103636b69646161")},
+		{"negative keys bytewise", Builder{ModeSort: ModeSortBytewiseLexical}, coseKey{Crv: 1, Kty: 2, X: []byte{3}, Kid: "a"}, hexDecode("a401022001214103636b69646161")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.b
+			b.Marshal(tt.v)
+			if got, err := b.Bytes(); err != nil {
+				t.Errorf("Marshal(%v) returned error %v", tt.v, err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Errorf("Marshal(%v) = 0x%x, want 0x%x", tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarshalKeyAsIntInvalid(t *testing.T) {
+	type s struct {
+		A int `cbor:"a,keyasint"`
+	}
+	_, err := Marshal(s{})
+	if want := `cbor: invalid keyasint name "a" for field cbor.s.A`; err == nil || err.Error() != want {
+		t.Errorf("Marshal() returned error %v, want %s", err, want)
+	}
+}
+
+func TestModeUseJSONTags(t *testing.T) {
+	type s struct {
+		Name     string `json:"name"`
+		Skip     int    `json:"-"`
+		Empty    int    `json:"empty,omitempty"`
+		Both     int    `json:"json" cbor:"cbor"`
+		Untagged int
+	}
+	v := s{Name: "a", Skip: 1, Both: 2, Untagged: 3}
+	tests := []struct {
+		name string
+		b    Builder
+		want []byte
+	}{
+		{"json tags", Builder{ModeUseJSONTags: true}, hexDecode("a3646e616d6561616463626f720268556e74616767656403")},
+		{"cbor tags only", Builder{}, hexDecode("a5644e616d65616164536b69700165456d707479006463626f720268556e74616767656403")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.b
+			b.ModeSort = ModeSortNone
+			b.Marshal(v)
+			if got, err := b.Bytes(); err != nil {
+				t.Errorf("Marshal(%v) returned error %v", v, err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Errorf("Marshal(%v) = 0x%x, want 0x%x", v, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddNullable(t *testing.T) {
+	i := 10
+	s := "a"
+	p := inner{X: 1, Y: 2}
+	var b Builder
+	b.AddArray(6, func(b *Builder) {
+		AddNullable(b, &i, (*Builder).AddInt)
+		AddNullable(b, (*int)(nil), (*Builder).AddInt)
+		AddNullable(b, &s, (*Builder).AddString)
+		AddNullable(b, (*string)(nil), (*Builder).AddString)
+		AddNullable(b, &p, func(b *Builder, v inner) {
+			b.AddArray(2, func(b *Builder) {
+				b.AddInt64(v.X)
+				b.AddInt64(v.Y)
+			})
+		})
+		AddNullable(b, (*inner)(nil), func(b *Builder, v inner) {
+			t.Error("enc called for nil pointer")
+		})
+	})
+	want := hexDecode("860af66161f6820102f6")
+	if got, err := b.Bytes(); err != nil {
+		t.Errorf("AddNullable() returned error %v", err)
+	} else if !bytes.Equal(got, want) {
+		t.Errorf("AddNullable() = 0x%x, want 0x%x", got, want)
+	}
+}
+
+func TestAddOptional(t *testing.T) {
+	var b Builder
+	b.AddArray(4, func(b *Builder) {
+		AddOptional(b, 10, 0, (*Builder).AddInt)
+		AddOptional(b, 0, 0, (*Builder).AddInt)
+		AddOptional(b, "a", "", (*Builder).AddString)
+		AddOptional(b, "", "", func(b *Builder, v string) {
+			t.Error("enc called for zero value")
+		})
+	})
+	want := hexDecode("840af66161f6")
+	if got, err := b.Bytes(); err != nil {
+		t.Errorf("AddOptional() returned error %v", err)
+	} else if !bytes.Equal(got, want) {
+		t.Errorf("AddOptional() = 0x%x, want 0x%x", got, want)
+	}
+}
+
+func TestAddOptionalMap(t *testing.T) {
+	b := Builder{ModeSort: ModeSortNone}
+	b.AddMap(2)
+	b.AddMapItem(func(b *Builder) {
+		b.AddString("a")
+	}, func(b *Builder) {
+		AddOptional(b, 1.5, 0, (*Builder).AddFloat64)
+	})
+	b.AddMapItem(func(b *Builder) {
+		b.AddString("b")
+	}, func(b *Builder) {
+		AddOptional(b, 0.0, 0, (*Builder).AddFloat64)
+	})
+	want := hexDecode("a26161f93e006162f6")
+	if got, err := b.Bytes(); err != nil {
+		t.Errorf("AddOptional() returned error %v", err)
+	} else if !bytes.Equal(got, want) {
+		t.Errorf("AddOptional() = 0x%x, want 0x%x", got, want)
+	}
+}
+
+func TestMarshalToArray(t *testing.T) {
+	type toArray struct {
+		_      struct{} `cbor:",toarray"`
+		A      int      `cbor:"a"`
+		B      string   `cbor:"1,keyasint,omitempty"`
+		C      int      `cbor:"c,keyasint"`
+		Secret int      `cbor:"-"`
+	}
+	type toMap struct {
+		A int
+		B toArray
+	}
+	v := toMap{A: 1, B: toArray{A: 2, Secret: 3}}
+	want := hexDecode("a2614101614283026000")
+	b := Builder{StructAsMap: true}
+	b.Marshal(v)
+	if got, err := b.Bytes(); err != nil {
+		t.Errorf("Marshal(%v) returned error %v", v, err)
+	} else if !bytes.Equal(got, want) {
+		t.Errorf("Marshal(%v) = 0x%x, want 0x%x", v, got, want)
+	}
+}
+
+type embedBase struct {
+	ID   int
+	Name string
+}
+
+type embedMid struct {
+	embedBase
+	Extra int
+}
+
+type embedTop struct {
+	embedMid
+	Name string
+}
+
+func TestMarshalEmbedded(t *testing.T) {
+	type a struct{ X int }
+	type b struct{ X int }
+	type tagged struct {
+		X int `cbor:"X"`
+	}
+	type ambiguous struct {
+		a
+		b
+		Y int
+	}
+	type dominant struct {
+		a
+		tagged
+	}
+	type ptr struct {
+		*embedBase
+		Z int
+	}
+	top := embedTop{embedMid{embedBase{1, "base"}, 2}, "top"}
+	tests := []struct {
+		name string
+		b    Builder
+		v    interface{}
+		want []byte
+	}{
+		{"two levels", Builder{}, top, hexDecode("83010263746f70")},
+		{"two levels as map", Builder{StructAsMap: true}, top, hexDecode("a362494401644e616d6563746f7065457874726102")},
+		{"ambiguous", Builder{}, ambiguous{a{1}, b{2}, 3}, hexDecode("8103")},
+		{"tagged dominates", Builder{}, dominant{a{1}, tagged{2}}, hexDecode("a1615802")},
+		{"nil pointer", Builder{}, ptr{Z: 1}, hexDecode("83f6f601")},
+		{"nil pointer as map", Builder{StructAsMap: true}, ptr{Z: 1}, hexDecode("a1615a01")},
+		{"pointer", Builder{}, ptr{&embedBase{1, "a"}, 2}, hexDecode("8301616102")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.b
+			b.Marshal(tt.v)
+			if got, err := b.Bytes(); err != nil {
+				t.Errorf("Marshal(%v) returned error %v", tt.v, err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Errorf("Marshal(%v) = 0x%x, want 0x%x", tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+type treeNode struct {
+	Value    int
+	Children []*treeNode
+}
+
+func newTree(depth int) *treeNode {
+	root := &treeNode{Value: 1}
+	n := root
+	for i := 2; i <= depth; i++ {
+		child := &treeNode{Value: i}
+		n.Children = []*treeNode{child}
+		n = child
+	}
+	return root
+}
+
+func TestMarshalRecursiveType(t *testing.T) {
+	want := hexDecode("8201818202818203818204818205f6")
+	for _, maxDepth := range []int{0, 100} {
+		b := Builder{MaxNestingDepth: maxDepth}
+		b.Marshal(newTree(5))
+		if got, err := b.Bytes(); err != nil {
+			t.Errorf("Marshal() with max depth %d returned error %v", maxDepth, err)
+		} else if !bytes.Equal(got, want) {
+			t.Errorf("Marshal() with max depth %d = 0x%x, want 0x%x", maxDepth, got, want)
+		}
+	}
+
+	b := Builder{MaxNestingDepth: 100}
+	b.Marshal(newTree(100000))
+	if _, err := b.Bytes(); err == nil || err.Error() != "cbor: exceeded max nesting depth" {
+		t.Errorf("Marshal() returned error %v, want max nesting depth error", err)
+	}
+}
+
+func TestAddDenseIntMap(t *testing.T) {
+	tests := []struct {
+		name   string
+		mode   ModeDenseIntMap
+		values []interface{}
+		want   []byte
+	}{
+		{"dense map", ModeDenseIntMapNone, []interface{}{"a", "b", 1}, hexDecode("a30061610161620201")},
+		{"dense array", ModeDenseIntMapArray, []interface{}{"a", "b", 1}, hexDecode("836161616201")},
+		{"sparse map", ModeDenseIntMapNone, []interface{}{"a", nil, 1}, hexDecode("a20061610201")},
+		{"sparse fallback", ModeDenseIntMapArray, []interface{}{"a", nil, 1}, hexDecode("a20061610201")},
+		{"empty", ModeDenseIntMapArray, []interface{}{}, hexDecode("80")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := Builder{ModeDenseIntMap: tt.mode}
+			b.AddDenseIntMap(tt.values)
+			if got, err := b.Bytes(); err != nil {
+				t.Errorf("AddDenseIntMap() returned error %v", err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Errorf("AddDenseIntMap() = 0x%x, want 0x%x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarshalTimeUnixVectors(t *testing.T) {
+	tests := []struct {
+		v    time.Time
+		want []byte
+	}{
+		{time.Unix(1363896240, 0), hexDecode("c11a514b67b0")},
+		{time.Unix(1363896240, 500000000), hexDecode("c1fb41d452d9ec200000")},
+	}
+	for _, tt := range tests {
+		b := Builder{ModeTime: ModeTimeUnix}
+		b.AddTime(tt.v)
+		if got, err := b.Bytes(); err != nil {
+			t.Errorf("AddTime(%v) returned error %v", tt.v, err)
+		} else if !bytes.Equal(got, tt.want) {
+			t.Errorf("AddTime(%v) = 0x%x, want 0x%x", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestModeTimeUnixFloat(t *testing.T) {
+	tests := []struct {
+		name string
+		v    time.Time
+		want []byte
+	}{
+		// float64 can't hold all the digits, the result is rounded to 1363896240.1234567.
+		{"nanoseconds", time.Unix(1363896240, 123456789), hexDecode("c1fb41d452d9ec07e6b7")},
+		{"whole seconds", time.Unix(1363896240, 0), hexDecode("c1fb41d452d9ec000000")},
+		{"near epoch", time.Unix(0, 123456789), hexDecode("c1fb3fbf9add3739635f")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := Builder{ModeTime: ModeTimeUnixFloat}
+			b.AddTime(tt.v)
+			if got, err := b.Bytes(); err != nil {
+				t.Errorf("AddTime(%v) returned error %v", tt.v, err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Errorf("AddTime(%v) = 0x%x, want 0x%x", tt.v, got, tt.want)
+			}
+		})
+	}
+
+	// Near the epoch the float64 round-trips to the same nanosecond.
+	f := math.Float64frombits(binary.BigEndian.Uint64(hexDecode("3fbf9add3739635f")))
+	if ns := int64(math.Round(f * 1e9)); ns != 123456789 {
+		t.Errorf("round trip = %dns, want 123456789ns", ns)
+	}
+}
+
+func TestMarshalTime(t *testing.T) {
+	utc := time.Date(2013, 3, 21, 20, 4, 0, 0, time.UTC)
+	frac := time.Date(2013, 3, 21, 20, 4, 0, 500000000, time.UTC)
+	offset := time.Date(2013, 3, 21, 22, 4, 0, 123456789, time.FixedZone("", 2*60*60))
+	tests := []struct {
+		name string
+		mode ModeTime
+		v    interface{}
+		want interface{}
+	}{
+		{"utc", ModeTimeRFC3339, utc, Tag{0, "2013-03-21T20:04:00Z"}},
+		{"fractional", ModeTimeRFC3339, frac, Tag{0, "2013-03-21T20:04:00.5Z"}},
+		{"offset", ModeTimeRFC3339, offset, Tag{0, "2013-03-21T22:04:00.123456789+02:00"}},
+		{"pointer", ModeTimeRFC3339, &utc, Tag{0, "2013-03-21T20:04:00Z"}},
+		{"struct field", ModeTimeRFC3339, struct{ T time.Time }{utc}, []interface{}{Tag{0, "2013-03-21T20:04:00Z"}}},
+		{"unix", ModeTimeUnix, utc, Tag{1, uint64(1363896240)}},
+		{"unix offset", ModeTimeUnix, offset.Truncate(time.Second), Tag{1, uint64(1363896240)}},
+		{"unix fractional", ModeTimeUnix, frac, Tag{1, float64(1363896240.5)}},
+		{"unix before epoch", ModeTimeUnix, time.Unix(-2, 500000000), Tag{1, float64(-1.5)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want, err := Marshal(tt.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b := Builder{ModeTime: tt.mode}
+			b.Marshal(tt.v)
+			if got, err := b.Bytes(); err != nil {
+				t.Errorf("Marshal(%v) returned error %v", tt.v, err)
+			} else if !bytes.Equal(got, want) {
+				t.Errorf("Marshal(%v) = 0x%x, want 0x%x", tt.v, got, want)
+			}
+		})
+	}
+}
+
+func TestMarshalCharField(t *testing.T) {
+	type s struct {
+		Ch   rune  `cbor:"ch,char"`
+		Code int32 `cbor:"code"`
+	}
+	tests := []struct {
+		name    string
+		v       interface{}
+		want    []byte
+		wantErr string
+	}{
+		{"ascii", s{'a', 'a'}, hexDecode("a2626368616164636f64651861"), ""},
+		{"multibyte", s{'水', 0}, hexDecode("a262636863e6b0b464636f646500"), ""},
+		{"surrogate", s{0xd800, 0}, nil, "cbor: invalid rune 55296 for char field ch"},
+		{"invalid field type", struct {
+			Ch string `cbor:"ch,char"`
+		}{"a"}, nil, "cbor: char option requires a rune field, got string for field struct { Ch string \"cbor:\\\"ch,char\\\"\" }.Ch"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Marshal(tt.v)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("Marshal(%v) returned error %v, want %s", tt.v, err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Errorf("Marshal(%v) returned error %v", tt.v, err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Errorf("Marshal(%v) = 0x%x, want 0x%x", tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddIntMinimalHead(t *testing.T) {
+	// Values fit in 32 bits so the test is meaningful on all platforms.
+	tests := []struct {
+		v    int
+		want []byte
+	}{
+		{0, hexDecode("00")},
+		{5, hexDecode("05")},
+		{23, hexDecode("17")},
+		{24, hexDecode("1818")},
+		{255, hexDecode("18ff")},
+		{256, hexDecode("190100")},
+		{65535, hexDecode("19ffff")},
+		{65536, hexDecode("1a00010000")},
+		{math.MaxInt32, hexDecode("1a7fffffff")},
+		{-1, hexDecode("20")},
+		{-24, hexDecode("37")},
+		{-25, hexDecode("3818")},
+		{-256, hexDecode("38ff")},
+		{-257, hexDecode("390100")},
+		{-65537, hexDecode("3a00010000")},
+		{math.MinInt32, hexDecode("3a7fffffff")},
+	}
+	for _, tt := range tests {
+		var b Builder
+		b.AddInt(tt.v)
+		if got, _ := b.Bytes(); !bytes.Equal(got, tt.want) {
+			t.Errorf("AddInt(%d) = 0x%x, want 0x%x", tt.v, got, tt.want)
+		}
+		if tt.v < 0 {
+			continue
+		}
+		b = Builder{}
+		b.AddUint(uint(tt.v))
+		if got, _ := b.Bytes(); !bytes.Equal(got, tt.want) {
+			t.Errorf("AddUint(%d) = 0x%x, want 0x%x", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestAddByteStringHead(t *testing.T) {
+	// Heads are built directly to avoid allocating huge byte slices.
+	tests := []struct {
+		n    uint64
+		want []byte
+	}{
+		{math.MaxUint32, hexDecode("5affffffff")},
+		{math.MaxUint32 + 1, hexDecode("5b0000000100000000")},
+		{5_000_000_000, hexDecode("5b000000012a05f200")},
+		{math.MaxUint64, hexDecode("5bffffffffffffffff")},
+	}
+	for _, tt := range tests {
+		var b Builder
+		b.addUint64(cborTypeByteString, tt.n)
+		if got, _ := b.Bytes(); !bytes.Equal(got, tt.want) {
+			t.Errorf("addUint64(cborTypeByteString, %d) = 0x%x, want 0x%x", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestAddHeaders(t *testing.T) {
+	tests := []struct {
+		name string
+		add  func(*Builder, uint64)
+		n    uint64
+		want []byte
+	}{
+		{"array", (*Builder).AddArrayHeader, 0, hexDecode("80")},
+		{"array", (*Builder).AddArrayHeader, 23, hexDecode("97")},
+		{"array", (*Builder).AddArrayHeader, 24, hexDecode("9818")},
+		{"array", (*Builder).AddArrayHeader, 1000, hexDecode("9903e8")},
+		{"array", (*Builder).AddArrayHeader, math.MaxUint64, hexDecode("9bffffffffffffffff")},
+		{"map", (*Builder).AddMapHeader, 1, hexDecode("a1")},
+		{"map", (*Builder).AddMapHeader, 65536, hexDecode("ba00010000")},
+		{"bytes", (*Builder).AddBytesHeader, 4, hexDecode("44")},
+		{"bytes", (*Builder).AddBytesHeader, math.MaxUint32 + 1, hexDecode("5b0000000100000000")},
+		{"string", (*Builder).AddStringHeader, 0, hexDecode("60")},
+		{"string", (*Builder).AddStringHeader, 255, hexDecode("78ff")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+"/"+strconv.FormatUint(tt.n, 10), func(t *testing.T) {
+			var b Builder
+			tt.add(&b, tt.n)
+			if got, err := b.Bytes(); err != nil {
+				t.Errorf("header returned error %v", err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Errorf("header = 0x%x, want 0x%x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddHeadersItems(t *testing.T) {
+	var b Builder
+	b.AddMapHeader(2)
+	b.AddString("a")
+	b.AddArrayHeader(2)
+	b.AddInt(1)
+	b.AddInt(2)
+	b.AddString("b")
+	b.AddStringHeader(2)
+	b.AddRawBytes([]byte("hi"))
+	want := hexDecode("a26161820102616262" + "6869")
+	if got, err := b.Bytes(); err != nil {
+		t.Errorf("Bytes() returned error %v", err)
+	} else if !bytes.Equal(got, want) {
+		t.Errorf("Bytes() = 0x%x, want 0x%x", got, want)
+	}
+	if err := Valid(want); err != nil {
+		t.Errorf("Valid() returned error %v", err)
+	}
+}
+
+type textEnum int
+
+func (e textEnum) MarshalText() ([]byte, error) {
+	switch e {
+	case 1:
+		return []byte("one"), nil
+	}
+	return nil, errors.New("unknown enum")
+}
+
+type textPtr struct {
+	s string
+}
+
+func (p *textPtr) MarshalText() ([]byte, error) {
+	return []byte(p.s), nil
+}
+
+type textAndValue string
+
+func (textAndValue) MarshalText() ([]byte, error) {
+	return []byte("text"), nil
+}
+
+func (textAndValue) MarshalCBORValue(b *Builder) error {
+	b.AddInt(1)
+	return nil
+}
+
+func TestMarshalTextMarshaler(t *testing.T) {
+	tests := []struct {
+		name    string
+		v       interface{}
+		want    []byte
+		wantErr string
+	}{
+		{"value receiver", textEnum(1), hexDecode("636f6e65"), ""},
+		{"pointer receiver", textPtr{"abc"}, hexDecode("63616263"), ""},
+		{"pointer", &textPtr{"abc"}, hexDecode("63616263"), ""},
+		{"nil pointer", (*textPtr)(nil), hexDecode("f6"), ""},
+		{"struct field", struct{ E textEnum }{1}, hexDecode("81636f6e65"), ""},
+		{"net.IP", net.IPv4(192, 0, 2, 1), hexDecode("693139322e302e322e31"), ""},
+		{"MarshalingValue precedence", textAndValue("a"), hexDecode("01"), ""},
+		{"error", textEnum(2), nil, "unknown enum"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Marshal(tt.v)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("Marshal(%v) returned error %v, want %s", tt.v, err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Errorf("Marshal(%v) returned error %v", tt.v, err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Errorf("Marshal(%v) = 0x%x, want 0x%x", tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetFlushThreshold(t *testing.T) {
+	v := []interface{}{
+		make([]string, 100),
+		map[string]interface{}{
+			"z": []int{1, 2, 3},
+			"y": map[int]string{3: "c", 1: "a", 2: "b"},
+			"x": bytes.Repeat([]byte{1}, 300),
+		},
+		nestedSlice(20),
+	}
+	for i := range v[0].([]string) {
+		v[0].([]string)[i] = strings.Repeat("a", i)
+	}
+	want, err := Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []byte
+	var flushes int
+	var b Builder
+	b.SetFlushThreshold(64, func(p []byte) error {
+		flushes++
+		got = append(got, p...)
+		return nil
+	})
+	b.Marshal(v)
+	b.AddBytesUnknownLength(func(b *Builder) {
+		b.AddRawBytes(bytes.Repeat([]byte{2}, 100))
+	})
+	want = append(want, 0x58, 100)
+	want = append(want, bytes.Repeat([]byte{2}, 100)...)
+	if b.Len() >= 64+100 {
+		t.Errorf("Len() = %d, want bounded buffer", b.Len())
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatalf("Flush() returned error %v", err)
+	}
+	if flushes < 2 {
+		t.Errorf("sink called %d times, want several", flushes)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("sink received 0x%x, want 0x%x", got, want)
+	}
+	if b.Len() != 0 {
+		t.Errorf("Len() = %d after Flush, want 0", b.Len())
+	}
+}
+
+func TestSetFlushThresholdError(t *testing.T) {
+	wantErr := errors.New("sink error")
+	var b Builder
+	b.SetFlushThreshold(1, func(p []byte) error {
+		return wantErr
+	})
+	b.AddArray(2, func(b *Builder) {
+		b.AddInt(1)
+		b.AddInt(2)
+	})
+	if _, err := b.Bytes(); err != wantErr {
+		t.Errorf("Bytes() returned error %v, want %v", err, wantErr)
+	}
+}
+
+type uuid [16]byte
+
+func (u uuid) MarshalBinary() ([]byte, error) {
+	return u[:], nil
+}
+
+func (u uuid) MarshalText() ([]byte, error) {
+	return []byte("text"), nil
+}
+
+type binaryPtr struct {
+	err error
+}
+
+func (p *binaryPtr) MarshalBinary() ([]byte, error) {
+	return []byte{1, 2}, p.err
+}
+
+func TestMarshalBinaryMarshaler(t *testing.T) {
+	id := uuid{0: 0xf8, 15: 0x01}
+	tests := []struct {
+		name    string
+		v       interface{}
+		want    []byte
+		wantErr string
+	}{
+		{"value receiver over text", id, hexDecode("50f8000000000000000000000000000001"), ""},
+		{"pointer receiver", binaryPtr{}, hexDecode("420102"), ""},
+		{"struct field", struct{ ID uuid }{id}, hexDecode("8150f8000000000000000000000000000001"), ""},
+		{"error", binaryPtr{errors.New("binary error")}, nil, "binary error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Marshal(tt.v)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("Marshal(%v) returned error %v, want %s", tt.v, err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Errorf("Marshal(%v) returned error %v", tt.v, err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Errorf("Marshal(%v) = 0x%x, want 0x%x", tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarshalBigIntNested(t *testing.T) {
+	big1 := bigIntOrPanic("18446744073709551616")
+	type s struct {
+		A *big.Int
+		B *big.Int
+		C big.Int
+	}
+	tests := []struct {
+		name string
+		v    interface{}
+		want []byte
+	}{
+		{"pointer", &big1, hexDecode("c249010000000000000000")},
+		{"nil pointer", (*big.Int)(nil), hexDecode("f6")},
+		{"slice of pointers", []*big.Int{big.NewInt(1), nil, &big1}, hexDecode("8301f6c249010000000000000000")},
+		{"array of pointers", [2]*big.Int{big.NewInt(-1), &big1}, hexDecode("8220c249010000000000000000")},
+		{"map of values", map[string]big.Int{"a": *big.NewInt(1), "b": big1}, hexDecode("a26161016162c249010000000000000000")},
+		{"map of pointers", map[string]*big.Int{"a": big.NewInt(1), "b": nil}, hexDecode("a26161016162f6")},
+		{"struct fields", s{A: &big1, C: *big.NewInt(-2)}, hexDecode("83c249010000000000000000f621")},
+		{"interface slice", []interface{}{big1, &big1}, hexDecode("82c249010000000000000000c249010000000000000000")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := Marshal(tt.v); err != nil {
+				t.Errorf("Marshal(%v) returned error %v", tt.v, err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Errorf("Marshal(%v) = 0x%x, want 0x%x", tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddBigFloat(t *testing.T) {
+	large, _, err := big.ParseFloat("1267650600228229401496703205377", 10, 200, big.ToNearestEven) // 2^100+1
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		v    interface{}
+		want []byte
+	}{
+		// 5([-1, 3]), from RFC 8949 section 3.4.4.
+		{"normal float", big.NewFloat(1.5), hexDecode("c5822003")},
+		{"normal float value", *big.NewFloat(1.5), hexDecode("c5822003")},
+		{"integer", big.NewFloat(4), hexDecode("c5820201")},
+		{"negative", big.NewFloat(-0.75), hexDecode("c5822122")},
+		{"zero", big.NewFloat(0), hexDecode("c5820000")},
+		// 5([0, 2(h'10000000000000000000000001')])
+		{"bignum mantissa", large, hexDecode("c58200c24d10000000000000000000000001")},
+		{"nil", (*big.Float)(nil), hexDecode("f6")},
+		{"struct field", struct{ F *big.Float }{big.NewFloat(1.5)}, hexDecode("81c5822003")},
+		{"nested value", []big.Float{*big.NewFloat(1.5)}, hexDecode("81c5822003")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := Marshal(tt.v); err != nil {
+				t.Errorf("Marshal(%v) returned error %v", tt.v, err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Errorf("Marshal(%v) = 0x%x, want 0x%x", tt.v, got, tt.want)
+			}
+		})
+	}
+
+	var b Builder
+	b.AddBigFloat(new(big.Float).SetInf(false))
+	if _, err := b.Bytes(); err == nil {
+		t.Error("AddBigFloat(+Inf) returned no error")
+	}
+}
+
+func TestMap259(t *testing.T) {
+	m := Map259{{3, "c"}, {1, "a"}, {2, "b"}}
+	tests := []struct {
+		name string
+		b    Builder
+		v    interface{}
+		want []byte
+	}{
+		{"insertion order", Builder{ModeSort: ModeSortNone}, m, hexDecode("d90103a3036163016161026162")},
+		{"sorted", Builder{ModeSort: ModeSortLengthFirst}, m, hexDecode("d90103a3016161026162036163")},
+		{"empty", Builder{}, Map259{}, hexDecode("d90103a0")},
+		{"nested", Builder{}, []interface{}{Map259{{[]int{1}, true}}}, hexDecode("81d90103a18101f5")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.b
+			b.Marshal(tt.v)
+			if got, err := b.Bytes(); err != nil {
+				t.Errorf("Marshal(%v) returned error %v", tt.v, err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Errorf("Marshal(%v) = 0x%x, want 0x%x", tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddBigRat(t *testing.T) {
+	large, _ := new(big.Int).SetString("18446744073709551616", 10) // 2^64
+	tests := []struct {
+		name string
+		v    interface{}
+		want []byte
+	}{
+		{"one third", big.NewRat(1, 3), hexDecode("d81e820103")},
+		{"one third value", *big.NewRat(1, 3), hexDecode("d81e820103")},
+		{"lowest terms", big.NewRat(-2, 4), hexDecode("d81e822002")},
+		{"zero", new(big.Rat), hexDecode("d81e820001")},
+		{"bignum numerator", new(big.Rat).SetFrac(large, big.NewInt(3)), hexDecode("d81e82c24901000000000000000003")},
+		{"nil", (*big.Rat)(nil), hexDecode("f6")},
+		{"struct field", struct{ R *big.Rat }{big.NewRat(1, 3)}, hexDecode("81d81e820103")},
+		{"nested value", []big.Rat{*big.NewRat(1, 3)}, hexDecode("81d81e820103")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := Marshal(tt.v); err != nil {
+				t.Errorf("Marshal(%v) returned error %v", tt.v, err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Errorf("Marshal(%v) = 0x%x, want 0x%x", tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+type customValue struct {
+	A int
+	B string
+}
+
+func (customValue) MarshalCBORValue(b *Builder) error {
+	b.AddString("custom")
+	return nil
+}
+
+type customRaw struct {
+	A   int `cbor:"a"`
+	err error
+}
+
+func (c *customRaw) MarshalCBOR() ([]byte, error) {
+	return []byte{0x18, 0x2a}, c.err
+}
+
+type customBoth struct {
+	A int
+}
+
+func (customBoth) MarshalCBOR() ([]byte, error) {
+	return []byte{0x02}, nil
+}
+
+func (customBoth) MarshalCBORValue(b *Builder) error {
+	b.AddInt(1)
+	return nil
+}
+
+func TestMarshalCustomMarshalerPriority(t *testing.T) {
+	tests := []struct {
+		name string
+		v    interface{}
+		want []byte
+	}{
+		{"MarshalingValue", customValue{1, "x"}, hexDecode("66637573746f6d")},
+		{"MarshalingValue pointer", &customValue{1, "x"}, hexDecode("66637573746f6d")},
+		{"MarshalingValue field", struct{ C customValue }{}, hexDecode("8166637573746f6d")},
+		{"Marshaler", &customRaw{A: 1}, hexDecode("182a")},
+		{"Marshaler addressable copy", customRaw{A: 1}, hexDecode("182a")},
+		{"Marshaler field", struct{ C customRaw }{}, hexDecode("81182a")},
+		{"Marshaler slice", []customRaw{{A: 1}, {A: 2}}, hexDecode("82182a182a")},
+		{"MarshalingValue first", customBoth{}, hexDecode("01")},
+		{"MarshalingValue first field", []customBoth{{}}, hexDecode("8101")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := Marshal(tt.v); err != nil {
+				t.Errorf("Marshal(%v) returned error %v", tt.v, err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Errorf("Marshal(%v) = 0x%x, want 0x%x", tt.v, got, tt.want)
+			}
+		})
+	}
+
+	wantErr := errors.New("test error")
+	if _, err := Marshal(&customRaw{err: wantErr}); err != wantErr {
+		t.Errorf("Marshal() returned error %v, want %v", err, wantErr)
+	}
+}
+
+func TestMarshalCWTClaims(t *testing.T) {
+	numericDate := func(sec, nsec int64) *NumericDate {
+		d := NumericDate(time.Unix(sec, nsec))
+		return &d
+	}
+	tests := []struct {
+		name string
+		v    CWTClaims
+		want []byte
+	}{
+		// From RFC 8392 appendix A.1.
+		{"rfc example", CWTClaims{
+			Issuer:     "coap://as.example.com",
+			Subject:    "erikw",
+			Audience:   "coap://light.example.com",
+			Expiration: numericDate(1444064944, 0),
+			NotBefore:  numericDate(1443944944, 0),
+			IssuedAt:   numericDate(1443944944, 0),
+			CWTID:      []byte{0x0b, 0x71},
+		}, hexDecode("a70175636f61703a2f2f61732e6578616d706c652e636f6d02656572696b77037818636f61703a2f2f6c696768742e6578616d706c652e636f6d041a5612aeb0051a5610d9f0061a5610d9f007420b71")},
+		// {4: 1444064944, 6: 1443944944.5}
+		{"fractional", CWTClaims{
+			Expiration: numericDate(1444064944, 0),
+			IssuedAt:   numericDate(1443944944, 5e8),
+		}, hexDecode("a2041a5612aeb006fb41d584367c200000")},
+		{"empty", CWTClaims{}, hexDecode("a0")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := Marshal(tt.v); err != nil {
+				t.Errorf("Marshal(%v) returned error %v", tt.v, err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Errorf("Marshal(%v) = 0x%x, want 0x%x", tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddStringIndefinite(t *testing.T) {
+	tests := []struct {
+		name    string
+		fn      BuilderContinuation
+		want    []byte
+		wantErr bool
+	}{
+		// (_ "strea", "ming"), from RFC 8949 appendix A.
+		{"chunks", func(b *Builder) {
+			b.AddString("strea")
+			b.AddString("ming")
+		}, hexDecode("7f657374726561646d696e67ff"), false},
+		{"no chunks", func(b *Builder) {}, hexDecode("7fff"), false},
+		{"long chunk", func(b *Builder) {
+			b.AddString(strings.Repeat("a", 24))
+		}, append(append(hexDecode("7f7818"), strings.Repeat("a", 24)...), 0xff), false},
+		{"empty chunk", func(b *Builder) {
+			b.AddString("")
+		}, hexDecode("7f60ff"), false},
+		{"byte string chunk", func(b *Builder) {
+			b.AddBytes([]byte{1})
+		}, nil, true},
+		{"nested indefinite chunk", func(b *Builder) {
+			b.AddStringIndefinite(func(b *Builder) {})
+		}, nil, true},
+		{"truncated chunk", func(b *Builder) {
+			b.AddRawBytes([]byte{0x62, 'a'})
+		}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b Builder
+			b.AddStringIndefinite(tt.fn)
+			got, err := b.Bytes()
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("AddStringIndefinite() = 0x%x, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("AddStringIndefinite() returned error %v", err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Errorf("AddStringIndefinite() = 0x%x, want 0x%x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddBytesIndefinite(t *testing.T) {
+	tests := []struct {
+		name    string
+		fn      BuilderContinuation
+		want    []byte
+		wantErr bool
+	}{
+		// (_ h'0102', h'030405'), from RFC 8949 appendix A.
+		{"chunks", func(b *Builder) {
+			b.AddBytes([]byte{1, 2})
+			b.AddBytes([]byte{3, 4, 5})
+		}, hexDecode("5f42010243030405ff"), false},
+		{"no chunks", func(b *Builder) {}, hexDecode("5fff"), false},
+		{"unknown length chunk", func(b *Builder) {
+			b.AddBytesUnknownLength(func(b *Builder) {
+				b.add(1, 2)
+			})
+		}, hexDecode("5f420102ff"), false},
+		{"text string chunk", func(b *Builder) {
+			b.AddString("a")
+		}, nil, true},
+		{"nested indefinite chunk", func(b *Builder) {
+			b.AddBytesIndefinite(func(b *Builder) {})
+		}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b Builder
+			b.AddBytesIndefinite(tt.fn)
+			got, err := b.Bytes()
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("AddBytesIndefinite() = 0x%x, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("AddBytesIndefinite() returned error %v", err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Errorf("AddBytesIndefinite() = 0x%x, want 0x%x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarshalMapBigIntValues(t *testing.T) {
+	pow64, _ := new(big.Int).SetString("18446744073709551616", 10)
+	v := map[string]interface{}{
+		"a": big.NewInt(1),
+		"b": big.NewInt(-1),
+		"c": new(big.Int).SetUint64(math.MaxUint64),
+		"d": pow64,
+		"e": new(big.Int).Neg(new(big.Int).Add(pow64, big.NewInt(1))),
+		"f": (*big.Int)(nil),
+	}
+	want := hexDecode("a6" +
+		"616101" +
+		"616220" +
+		"61631bffffffffffffffff" +
+		"6164c249010000000000000000" +
+		"6165c349010000000000000000" +
+		"6166f6")
+	if got, err := Marshal(v); err != nil {
+		t.Errorf("Marshal(%v) returned error %v", v, err)
+	} else if !bytes.Equal(got, want) {
+		t.Errorf("Marshal(%v) = 0x%x, want 0x%x", v, got, want)
+	}
+}
+
+func TestAddIntArray(t *testing.T) {
+	tests := []struct {
+		v    []int
+		want []byte
+	}{
+		{nil, hexDecode("80")},
+		{[]int{}, hexDecode("80")},
+		{[]int{1, -1, 1000}, hexDecode("8301201903e8")},
+	}
+	for _, tt := range tests {
+		var b Builder
+		b.AddIntArray(tt.v)
+		if got, _ := b.Bytes(); !bytes.Equal(got, tt.want) {
+			t.Errorf("AddIntArray(%v) = 0x%x, want 0x%x", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestAddFloat64Array(t *testing.T) {
+	tests := []struct {
+		mode ModeFloat
+		v    []float64
+		want []byte
+	}{
+		{ModeFloat16, nil, hexDecode("80")},
+		{ModeFloat16, []float64{1.5, 100000}, hexDecode("82f93e00fa47c35000")},
+		{ModeFloatNone, []float64{1.5}, hexDecode("81fb3ff8000000000000")},
+	}
+	for _, tt := range tests {
+		b := Builder{ModeFloat: tt.mode}
+		b.AddFloat64Array(tt.v)
+		if got, _ := b.Bytes(); !bytes.Equal(got, tt.want) {
+			t.Errorf("AddFloat64Array(%v) = 0x%x, want 0x%x", tt.v, got, tt.want)
+		}
+	}
+}
+
+func BenchmarkAddIntArray(b *testing.B) {
+	v := make([]int, 1000)
+	for i := range v {
+		v[i] = i * 1000
+	}
+	b.Run("AddIntArray", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var bld Builder
+			bld.AddIntArray(v)
+			if _, err := bld.Bytes(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Marshal", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := Marshal(v); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestReset(t *testing.T) {
+	b := Builder{ModeSort: ModeSortNone}
+	b.Marshal(map[string]int{"a": 1})
+	b.SetError(errors.New("test error"))
+	b.Reset()
+	if b.Len() != 0 {
+		t.Errorf("Len() = %d, want 0", b.Len())
+	}
+	c := cap(b.result)
+	b.Marshal(Map259{{2, 2}, {1, 1}})
+	got, err := b.Bytes()
+	if err != nil {
+		t.Fatalf("Bytes() returned error %v", err)
+	}
+	// The mode is kept, so the keys are not sorted.
+	if want := hexDecode("d90103a202020101"); !bytes.Equal(got, want) {
+		t.Errorf("Bytes() = 0x%x, want 0x%x", got, want)
+	}
+	if cap(b.result) != c {
+		t.Errorf("cap(result) = %d, want %d", cap(b.result), c)
+	}
+}
+
+func BenchmarkReset(b *testing.B) {
+	v := map[string]interface{}{"a": []int{1, 2, 3}, "b": "text", "c": 1.5}
+	b.Run("Marshal", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := Marshal(v); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Reset", func(b *testing.B) {
+		b.ReportAllocs()
+		var bld Builder
+		for i := 0; i < b.N; i++ {
+			bld.Reset()
+			bld.Marshal(v)
+			if _, err := bld.Bytes(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+type loopError struct{}
+
+func (e *loopError) Error() string { return "loop" }
+
+func (e *loopError) Unwrap() error { return e }
+
+func TestModeError(t *testing.T) {
+	type s struct {
+		Err error `cbor:"err"`
+	}
+	wrapped := fmt.Errorf("top: %w", fmt.Errorf("mid: %w", errors.New("root")))
+	tests := []struct {
+		name string
+		mode ModeError
+		v    interface{}
+		want []byte
+	}{
+		{"string", ModeErrorString, s{wrapped}, hexDecode("a1636572726e746f703a206d69643a20726f6f74")},
+		{"string nil", ModeErrorString, s{}, hexDecode("a163657272f6")},
+		// {"err": {"type": "*fmt.wrapError", "message": "top: mid: root", "cause": {
+		//   "type": "*fmt.wrapError", "message": "mid: root", "cause": {
+		//     "type": "*errors.errorString", "message": "root"}}}}
+		{"structured", ModeErrorStructured, s{wrapped}, hexDecode("a163657272a364747970656e2a666d742e777261704572726f72676d6573736167656e746f703a206d69643a20726f6f74656361757365a364747970656e2a666d742e777261704572726f72676d657373616765696d69643a20726f6f74656361757365a26474797065732a6572726f72732e6572726f72537472696e67676d65737361676564726f6f74")},
+		{"structured nil", ModeErrorStructured, s{}, hexDecode("a163657272f6")},
+		{"structured top level", ModeErrorStructured, errors.New("root"), hexDecode("a26474797065732a6572726f72732e6572726f72537472696e67676d65737361676564726f6f74")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := Builder{ModeError: tt.mode, ModeSort: ModeSortNone}
+			b.Marshal(tt.v)
+			if got, err := b.Bytes(); err != nil {
+				t.Errorf("Marshal(%v) returned error %v", tt.v, err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Errorf("Marshal(%v) = 0x%x, want 0x%x", tt.v, got, tt.want)
+			}
+		})
+	}
+
+	b := Builder{ModeError: ModeErrorStructured}
+	b.Marshal(&loopError{})
+	got, err := b.Bytes()
+	if err != nil {
+		t.Fatalf("Marshal(loopError) returned error %v", err)
+	}
+	if n := bytes.Count(got, []byte("cause")); n != maxErrorCauses {
+		t.Errorf("Marshal(loopError) encoded %d causes, want %d", n, maxErrorCauses)
+	}
+}
+
+func TestMarshalFlagSet(t *testing.T) {
+	tests := []struct {
+		name string
+		v    interface{}
+		want []byte
+	}{
+		// 258(["b", "ab", "ac"])
+		{"only true keys sorted", FlagSet{"ac": true, "off": false, "b": true, "ab": true}, hexDecode("d90102836162626162626163")},
+		{"empty", FlagSet{"off": false}, hexDecode("d9010280")},
+		{"nil", FlagSet(nil), hexDecode("d9010280")},
+		{"struct field", struct{ F FlagSet }{FlagSet{"a": true}}, hexDecode("81d90102816161")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := Marshal(tt.v); err != nil {
+				t.Errorf("Marshal(%v) returned error %v", tt.v, err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Errorf("Marshal(%v) = 0x%x, want 0x%x", tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCTAP2Canonical(t *testing.T) {
+	// A COSE EC2 public key as returned in CTAP2 attested credential data.
+	v := map[int]interface{}{
+		-3: []byte{2},
+		-2: []byte{1},
+		-1: 1,
+		1:  2,
+		3:  -7,
+	}
+	// {1: 2, 3: -7, -1: 1, -2: h'01', -3: h'02'}
+	want := hexDecode("a5010203262001214101224102")
+	b := CTAP2Canonical()
+	b.Marshal(v)
+	if got, err := b.Bytes(); err != nil {
+		t.Errorf("Marshal(%v) returned error %v", v, err)
+	} else if !bytes.Equal(got, want) {
+		t.Errorf("Marshal(%v) = 0x%x, want 0x%x", v, got, want)
+	}
+
+	b = CTAP2Canonical()
+	b.Marshal([]float64{1.5, math.Inf(1), math.NaN()})
+	want = hexDecode("83fb3ff8000000000000fb7ff0000000000000f97e00")
+	if got, err := b.Bytes(); err != nil {
+		t.Errorf("Marshal(floats) returned error %v", err)
+	} else if !bytes.Equal(got, want) {
+		t.Errorf("Marshal(floats) = 0x%x, want 0x%x", got, want)
+	}
+}
+
+func TestCoreDeterministic(t *testing.T) {
+	v := map[interface{}]interface{}{
+		"aa": 5,
+		"z":  3,
+		100:  4,
+		-1:   2,
+		10:   1,
+	}
+	// {10: 1, 100: 4, -1: 2, "z": 3, "aa": 5}
+	want := hexDecode("a50a011864042002617a0362616105")
+	var first []byte
+	for i := 0; i < 10; i++ {
+		b := CoreDeterministic()
+		b.Marshal(v)
+		got, err := b.Bytes()
+		if err != nil {
+			t.Fatalf("Marshal(%v) returned error %v", v, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("Marshal(%v) = 0x%x, want 0x%x", v, got, want)
+		}
+		if first != nil && !bytes.Equal(got, first) {
+			t.Fatalf("Marshal(%v) = 0x%x, previously 0x%x", v, got, first)
+		}
+		first = got
+	}
+
+	b := CoreDeterministic()
+	b.Marshal([]float64{1.5, 100000, math.Inf(-1), math.NaN()})
+	want = hexDecode("84f93e00fa47c35000f9fc00f97e00")
+	if got, err := b.Bytes(); err != nil {
+		t.Errorf("Marshal(floats) returned error %v", err)
+	} else if !bytes.Equal(got, want) {
+		t.Errorf("Marshal(floats) = 0x%x, want 0x%x", got, want)
+	}
+}
+
+func TestAddIntBoundaries(t *testing.T) {
+	tests := []struct {
+		name string
+		fn   BuilderContinuation
+		want []byte
+	}{
+		{"MinInt8", func(b *Builder) { b.AddInt8(math.MinInt8) }, hexDecode("387f")},
+		{"MaxInt8", func(b *Builder) { b.AddInt8(math.MaxInt8) }, hexDecode("187f")},
+		{"MinInt16", func(b *Builder) { b.AddInt16(math.MinInt16) }, hexDecode("397fff")},
+		{"MaxInt16", func(b *Builder) { b.AddInt16(math.MaxInt16) }, hexDecode("197fff")},
+		{"MinInt32", func(b *Builder) { b.AddInt32(math.MinInt32) }, hexDecode("3a7fffffff")},
+		{"MaxInt32", func(b *Builder) { b.AddInt32(math.MaxInt32) }, hexDecode("1a7fffffff")},
+		{"MinInt64", func(b *Builder) { b.AddInt64(math.MinInt64) }, hexDecode("3b7fffffffffffffff")},
+		{"MaxInt64", func(b *Builder) { b.AddInt64(math.MaxInt64) }, hexDecode("1b7fffffffffffffff")},
+		{"MinInt64 Marshal", func(b *Builder) { b.Marshal(int64(math.MinInt64)) }, hexDecode("3b7fffffffffffffff")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b Builder
+			tt.fn(&b)
+			if got, _ := b.Bytes(); !bytes.Equal(got, tt.want) {
+				t.Errorf("got 0x%x, want 0x%x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddTypedArray(t *testing.T) {
+	tests := []struct {
+		name string
+		v    interface{}
+		want []byte
+	}{
+		{"uint8", []uint8{1, 2, 3}, hexDecode("d84043010203")},
+		{"uint8 empty", []uint8{}, hexDecode("d84040")},
+		{"uint8 nil", []uint8(nil), hexDecode("d84040")},
+		{"uint16 nil", []uint16(nil), hexDecode("d84540")},
+		{"uint16", []uint16{1, 0x0203}, hexDecode("d84544" + "01000302")},
+		{"uint32", []uint32{1}, hexDecode("d84644" + "01000000")},
+		{"uint64", []uint64{1}, hexDecode("d84748" + "0100000000000000")},
+		{"int8", []int8{-1, 1}, hexDecode("d84842" + "ff01")},
+		{"int16", []int16{-2}, hexDecode("d84d42" + "feff")},
+		{"int32", []int32{-2}, hexDecode("d84e44" + "feffffff")},
+		{"int64", []int64{-2}, hexDecode("d84f48" + "feffffffffffffff")},
+		{"float32", []float32{1.5}, hexDecode("d85544" + "0000c03f")},
+		{"float64", []float64{1.5, -2}, hexDecode("d85650" + "000000000000f83f" + "00000000000000c0")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b Builder
+			b.AddTypedArray(tt.v)
+			if got, err := b.Bytes(); err != nil {
+				t.Errorf("AddTypedArray(%v) returned error %v", tt.v, err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Errorf("AddTypedArray(%v) = 0x%x, want 0x%x", tt.v, got, tt.want)
+			}
+		})
+	}
+
+	for _, v := range []interface{}{nil, []string{"a"}, []int{1}} {
+		var b Builder
+		b.AddTypedArray(v)
+		if _, err := b.Bytes(); err == nil {
+			t.Errorf("AddTypedArray(%v) returned no error", v)
+		}
+	}
+}
+
+func TestModeNaNPreservePayload(t *testing.T) {
+	tests := []struct {
+		name string
+		v    interface{}
+		want []byte
+	}{
+		{"quiet float64", math.Float64frombits(0x7ff8000000000000), hexDecode("f97e00")},
+		{"negative quiet float64", math.Float64frombits(0xfff8000000000000), hexDecode("f9fe00")},
+		{"signaling float64", math.Float64frombits(0x7ff4000000000000), hexDecode("f97d00")},
+		{"signaling float64 low payload", math.Float64frombits(0x7ff0000000000001), hexDecode("fb7ff0000000000001")},
+		{"float64 payload fits float32", math.Float64frombits(0x7ff8000020000000), hexDecode("fa7fc00001")},
+		{"float64 payload", math.Float64frombits(0x7ffc00000000beef), hexDecode("fb7ffc00000000beef")},
+		{"quiet float32", math.Float32frombits(0x7fc00000), hexDecode("f97e00")},
+		{"signaling float32", math.Float32frombits(0x7f800001), hexDecode("fa7f800001")},
+		{"float32 payload fits float16", math.Float32frombits(0xffa02000), hexDecode("f9fd01")},
+		{"finite", 1.5, hexDecode("f93e00")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := Builder{ModeNaN: ModeNaNPreservePayload}
+			b.Marshal(tt.v)
+			if got, err := b.Bytes(); err != nil {
+				t.Errorf("Marshal(%v) returned error %v", tt.v, err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Errorf("Marshal(%v) = 0x%x, want 0x%x", tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestModeNonFiniteReject(t *testing.T) {
+	tests := []struct {
+		name    string
+		b       Builder
+		v       interface{}
+		want    []byte
+		wantErr string
+	}{
+		{"NaN float64", Builder{ModeNaN: ModeNaNReject}, math.NaN(), nil, "cbor: NaN not permitted"},
+		{"NaN float32", Builder{ModeNaN: ModeNaNReject}, float32(math.NaN()), nil, "cbor: NaN not permitted"},
+		{"Inf float64", Builder{ModeInf: ModeInfReject}, math.Inf(1), nil, "cbor: Infinity not permitted"},
+		{"-Inf float32", Builder{ModeInf: ModeInfReject}, float32(math.Inf(-1)), nil, "cbor: Infinity not permitted"},
+		{"Inf in slice", Builder{ModeInf: ModeInfReject}, []float64{1, math.Inf(1)}, nil, "cbor: Infinity not permitted"},
+		{"NaN with Inf reject", Builder{ModeInf: ModeInfReject}, math.NaN(), hexDecode("f97e00"), ""},
+		{"Inf with NaN reject", Builder{ModeNaN: ModeNaNReject}, math.Inf(1), hexDecode("f97c00"), ""},
+		{"finite", Builder{ModeNaN: ModeNaNReject, ModeInf: ModeInfReject}, []float64{1.5, 100000}, hexDecode("82f93e00fa47c35000"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.b
+			b.Marshal(tt.v)
+			got, err := b.Bytes()
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("Marshal(%v) returned error %v, want %q", tt.v, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("Marshal(%v) returned error %v", tt.v, err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Errorf("Marshal(%v) = 0x%x, want 0x%x", tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDetectDuplicateKeys(t *testing.T) {
+	type s struct {
+		A int `cbor:"1,keyasint"`
+		M map[interface{}]interface{}
+	}
+	tests := []struct {
+		name    string
+		detect  bool
+		v       interface{}
+		want    []byte
+		wantErr bool
+	}{
+		{"duplicate keys", true, map[interface{}]interface{}{uint64(1): "a", int(1): "b"}, nil, true},
+		{"duplicate keys in struct field", true, s{M: map[interface{}]interface{}{int8(-1): 0, int64(-1): 0}}, nil, true},
+		{"unique keys", true, map[interface{}]interface{}{uint64(1): "a", int(-1): "b"}, hexDecode("a2016161206162"), false},
+		{"struct as map", true, s{A: 1}, hexDecode("a20101614df6"), false},
+		{"disabled", false, map[interface{}]interface{}{uint64(1): 0, int(1): 0}, hexDecode("a201000100"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := Builder{DetectDuplicateKeys: tt.detect}
+			b.Marshal(tt.v)
+			got, err := b.Bytes()
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Marshal(%v) = 0x%x, want error", tt.v, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("Marshal(%v) returned error %v", tt.v, err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Errorf("Marshal(%v) = 0x%x, want 0x%x", tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+type ptrValue struct {
+	n int
+}
+
+func (p *ptrValue) MarshalCBORValue(b *Builder) error {
+	b.AddInt(p.n)
+	return nil
+}
+
+func TestMarshalMapMarshalingValues(t *testing.T) {
+	tests := []struct {
+		name string
+		v    interface{}
+		want []byte
+	}{
+		{"value receiver", map[string]customValue{"a": {}}, hexDecode("a1616166637573746f6d")},
+		{"value receiver pointer", map[string]*customValue{"a": {}, "b": nil}, hexDecode("a2616166637573746f6d6162f6")},
+		{"pointer receiver", map[string]ptrValue{"a": {1}, "b": {2}}, hexDecode("a2616101616202")},
+		{"pointer receiver pointer", map[string]*ptrValue{"a": {1}, "b": nil}, hexDecode("a26161016162f6")},
+		{"interface", map[string]interface{}{"a": customValue{}, "b": &ptrValue{2}}, hexDecode("a2616166637573746f6d616202")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := Marshal(tt.v); err != nil {
+				t.Errorf("Marshal(%v) returned error %v", tt.v, err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Errorf("Marshal(%v) = 0x%x, want 0x%x", tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddMapSortNoneOrder(t *testing.T) {
+	keys := []interface{}{"zz", 10, "a", -1, 1, []byte{0}}
+	b := Builder{ModeSort: ModeSortNone}
+	b.AddMap(len(keys))
+	for i, k := range keys {
+		b.AddMapItem(func(b *Builder) {
+			b.Marshal(k)
+		}, func(b *Builder) {
+			b.AddInt(i)
+		})
+	}
+	// {"zz": 0, 10: 1, "a": 2, -1: 3, 1: 4, h'00': 5}
+	want := hexDecode("a6627a7a000a0161610220030104410005")
+	if got, err := b.Bytes(); err != nil {
+		t.Errorf("Bytes() returned error %v", err)
+	} else if !bytes.Equal(got, want) {
+		t.Errorf("Bytes() = 0x%x, want 0x%x", got, want)
+	}
+}
+
+func TestAddRawMapEntry(t *testing.T) {
+	keys := []interface{}{"zz", 10, "a", -1, 1, []byte{0}, map[string]int{"k": 1}}
+	for _, mode := range []ModeSort{ModeSortLengthFirst, ModeSortBytewiseLexical, ModeSortNone} {
+		raw := Builder{ModeSort: mode}
+		closures := Builder{ModeSort: mode}
+		raw.AddMap(len(keys))
+		closures.AddMap(len(keys))
+		for i, k := range keys {
+			key, err := Marshal(k)
+			if err != nil {
+				t.Fatal(err)
+			}
+			value, err := Marshal([]int{i})
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw.AddRawMapEntry(key, value)
+			closures.AddMapItem(func(b *Builder) {
+				b.Marshal(k)
+			}, func(b *Builder) {
+				b.Marshal([]int{i})
+			})
+		}
+		got, err := raw.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := closures.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("ModeSort %d: AddRawMapEntry built 0x%x, want 0x%x", mode, got, want)
+		}
+		// {1: [4], 10: [1], -1: [3], h'00': [5], "a": [2], "zz": [0], {"k": 1}: [6]}
+		if sorted := hexDecode("a70181040a81012081034100810561618102627a7a8100a1616b018106"); mode == ModeSortLengthFirst && !bytes.Equal(got, sorted) {
+			t.Errorf("AddRawMapEntry built 0x%x, want 0x%x", got, sorted)
+		}
+	}
+
+	b := Builder{DetectDuplicateKeys: true}
+	b.AddMap(2)
+	b.AddRawMapEntry(hexDecode("01"), hexDecode("f5"))
+	b.AddRawMapEntry(hexDecode("01"), hexDecode("f4"))
+	if _, err := b.Bytes(); err == nil {
+		t.Error("duplicate raw keys were not detected")
+	}
+}
+
+func TestModeFloat32(t *testing.T) {
+	tests := []struct {
+		v    interface{}
+		want []byte
+	}{
+		{1.5, hexDecode("fa3fc00000")},
+		{float32(1.5), hexDecode("fa3fc00000")},
+		{100000.0, hexDecode("fa47c35000")},
+		{1.1, hexDecode("fb3ff199999999999a")},
+		{math.Inf(1), hexDecode("f97c00")},
+		{math.NaN(), hexDecode("f97e00")},
+	}
+	for _, tt := range tests {
+		b := Builder{ModeFloat: ModeFloat32}
+		b.Marshal(tt.v)
+		if got, _ := b.Bytes(); !bytes.Equal(got, tt.want) {
+			t.Errorf("Marshal(%v) = 0x%x, want 0x%x", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestModeByteSlice(t *testing.T) {
+	type bytesType []byte
+	tests := []struct {
+		name string
+		mode ModeByteSlice
+		v    interface{}
+		want []byte
+	}{
+		{"slice byte string", ModeByteSliceByteString, []byte{1, 2, 3}, hexDecode("43010203")},
+		{"slice array", ModeByteSliceArray, []byte{1, 2, 3}, hexDecode("83010203")},
+		{"array values above 23", ModeByteSliceArray, []byte{24, 255}, hexDecode("82181818ff")},
+		{"nil array", ModeByteSliceArray, []byte(nil), hexDecode("f6")},
+		{"named slice byte string", ModeByteSliceByteString, bytesType{1, 2, 3}, hexDecode("43010203")},
+		{"named slice array", ModeByteSliceArray, bytesType{1, 2, 3}, hexDecode("83010203")},
+		{"go array byte string", ModeByteSliceByteString, [3]byte{1, 2, 3}, hexDecode("43010203")},
+		{"go array array", ModeByteSliceArray, [3]byte{1, 2, 3}, hexDecode("83010203")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := Builder{ModeByteSlice: tt.mode}
+			b.Marshal(tt.v)
+			if got, err := b.Bytes(); err != nil {
+				t.Errorf("Marshal(%v) returned error %v", tt.v, err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Errorf("Marshal(%v) = 0x%x, want 0x%x", tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+type benchRecord struct {
+	ID    int
+	Name  string
+	Score float64
+}
+
+func BenchmarkMarshalPointerSlice(b *testing.B) {
+	v := make([]*benchRecord, 10000)
+	for i := range v {
+		if i%10 != 0 {
+			v[i] = &benchRecord{ID: i, Name: "record", Score: float64(i) / 2}
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Marshal(v); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestMarshalPointerSlice(t *testing.T) {
+	one := 1
+	tests := []struct {
+		name string
+		v    interface{}
+		want []byte
+	}{
+		{"structs", []*benchRecord{{1, "a", 1.5}, nil}, hexDecode("8283016161f93e00f6")},
+		{"ints", []*int{&one, nil}, hexDecode("8201f6")},
+		{"go array", [2]*int{nil, &one}, hexDecode("82f601")},
+		{"marshalers", []*ptrValue{{2}, nil}, hexDecode("8202f6")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := Marshal(tt.v); err != nil {
+				t.Errorf("Marshal(%v) returned error %v", tt.v, err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Errorf("Marshal(%v) = 0x%x, want 0x%x", tt.v, got, tt.want)
+			}
+		})
+	}
+
+	// Dereferencing elements counts as one nesting level, as in value.
+	b := Builder{MaxNestingDepth: 3}
+	b.Marshal([]*[]int{{1}})
+	if _, err := b.Bytes(); err == nil {
+		t.Error("Marshal() exceeding MaxNestingDepth returned no error")
+	}
+}
+
+func TestMarshalNilPointerFields(t *testing.T) {
+	type node struct {
+		In   *inner
+		Next *node
+	}
+	type tagged struct {
+		In *inner `cbor:"in"`
+	}
+	type double struct {
+		PP **inner
+	}
+	type slice struct {
+		S []*inner
+	}
+	var tags TagSet
+	tags.Add(reflect.TypeOf((*inner)(nil)), 100)
+	tests := []struct {
+		name string
+		b    Builder
+		v    interface{}
+		want []byte
+	}{
+		{"field", Builder{}, node{}, hexDecode("82f6f6")},
+		{"nested field", Builder{}, node{Next: &node{}}, hexDecode("82f682f6f6")},
+		{"map field", Builder{}, tagged{}, hexDecode("a162696ef6")},
+		{"struct as map", Builder{StructAsMap: true}, node{Next: &node{}}, hexDecode("a262496ef6644e657874a262496ef6644e657874f6")},
+		{"pointer to nil pointer", Builder{}, double{new(*inner)}, hexDecode("81f6")},
+		{"slice element", Builder{}, slice{[]*inner{nil, {X: 1, Y: 2}}}, hexDecode("8182f6820102")},
+		{"interface element", Builder{}, []interface{}{(*inner)(nil)}, hexDecode("81f6")},
+		{"tagged pointer type", Builder{Tags: &tags}, []interface{}{(*inner)(nil), &inner{X: 1, Y: 2}}, hexDecode("82f6d864820102")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.b
+			b.Marshal(tt.v)
+			if got, err := b.Bytes(); err != nil {
+				t.Errorf("Marshal() returned error %v", err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Errorf("Marshal() = 0x%x, want 0x%x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPadTo(t *testing.T) {
+	tests := []struct {
+		name      string
+		v         interface{}
+		alignment int
+		want      []byte
+	}{
+		{"aligned", uint8(1), 1, hexDecode("01")},
+		{"one byte", "abc", 5, hexDecode("6361626340")},
+		{"short", uint8(1), 4, hexDecode("01420000")},
+		{"no shortest head fits", uint8(1), 26, append(append(hexDecode("0157"), make([]byte, 23)...), 0x40)},
+		{"two byte head", uint8(1), 28, append(hexDecode("015819"), make([]byte, 25)...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b Builder
+			b.Marshal(tt.v)
+			b.PadTo(tt.alignment)
+			got, err := b.Bytes()
+			if err != nil {
+				t.Fatalf("PadTo(%d) returned error %v", tt.alignment, err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("PadTo(%d) = 0x%x, want 0x%x", tt.alignment, got, tt.want)
+			}
+		})
+	}
+
+	for _, alignment := range []int{8, 25, 256, 259, 65539, 65540} {
+		for size := 0; size < 30; size++ {
+			var b Builder
+			b.AddBytes(make([]byte, size))
+			b.PadTo(alignment)
+			if got := b.Len(); got%alignment != 0 {
+				t.Errorf("PadTo(%d) after %d bytes returned length %d", alignment, size, got)
+			}
+		}
+	}
+
+	var sink bytes.Buffer
+	var b Builder
+	b.SetFlushThreshold(1, func(p []byte) error {
+		sink.Write(p)
+		return nil
+	})
+	b.AddString("abc")
+	b.PadTo(8)
+	b.Flush()
+	if sink.Len() != 8 {
+		t.Errorf("PadTo(8) after flushing wrote %d bytes, want 8", sink.Len())
+	}
+
+	b = Builder{}
+	b.PadTo(0)
+	if _, err := b.Bytes(); err == nil {
+		t.Error("PadTo(0) returned no error")
+	}
+}
+
+func TestValidateUTF8(t *testing.T) {
+	tests := []struct {
+		name     string
+		validate bool
+		v        interface{}
+		want     []byte
+		wantErr  bool
+	}{
+		{"multibyte", true, "ü水", hexDecode("65c3bce6b0b4"), false},
+		{"invalid", true, "a\xffb", nil, true},
+		{"invalid map key", true, map[string]int{"\xc3": 1}, nil, true},
+		{"invalid struct field", true, struct{ S string }{"\xe6\xb0"}, nil, true},
+		{"invalid not validated", false, "a\xffb", hexDecode("6361ff62"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := Builder{ValidateUTF8: tt.validate}
+			b.Marshal(tt.v)
+			got, err := b.Bytes()
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Marshal(%q) = 0x%x, want error", tt.v, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("Marshal(%q) returned error %v", tt.v, err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Errorf("Marshal(%q) = 0x%x, want 0x%x", tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelfDescribe(t *testing.T) {
+	b := Builder{SelfDescribe: true}
+	b.Marshal([]interface{}{1, []int{2}})
+	want := hexDecode("d9d9f782018102")
+	if got, err := b.Bytes(); err != nil {
+		t.Errorf("Marshal() returned error %v", err)
+	} else if !bytes.Equal(got, want) {
+		t.Errorf("Marshal() = 0x%x, want 0x%x", got, want)
+	}
+
+	// The tag is only prepended once for the whole document.
+	b.Marshal(3)
+	want = hexDecode("d9d9f78201810203")
+	if got, _ := b.Bytes(); !bytes.Equal(got, want) {
+		t.Errorf("Marshal() = 0x%x, want 0x%x", got, want)
+	}
+
+	b.Reset()
+	b.Marshal(3)
+	want = hexDecode("d9d9f703")
+	if got, _ := b.Bytes(); !bytes.Equal(got, want) {
+		t.Errorf("Marshal() after Reset() = 0x%x, want 0x%x", got, want)
+	}
+
+	b = Builder{}
+	b.AddSelfDescribeTag()
+	b.AddString("a")
+	want = hexDecode("d9d9f76161")
+	if got, _ := b.Bytes(); !bytes.Equal(got, want) {
+		t.Errorf("AddSelfDescribeTag() = 0x%x, want 0x%x", got, want)
+	}
+}
+
+func TestMarshalMapFloatValues(t *testing.T) {
+	v := map[string]interface{}{
+		"c": 100000.0,
+		"b": 1.1,
+		"a": 1.0,
+		"d": float32(0.5),
+	}
+	// {"a": 1.0 (float16), "b": 1.1 (float64), "c": 100000.0 (float32), "d": 0.5 (float16)}
+	want := hexDecode("a46161f93c006162fb3ff199999999999a6163fa47c350006164f93800")
+	for i := 0; i < 5; i++ {
+		b := Builder{ModeFloat: ModeFloat16}
+		b.Marshal(v)
+		if got, err := b.Bytes(); err != nil {
+			t.Fatalf("Marshal(%v) returned error %v", v, err)
+		} else if !bytes.Equal(got, want) {
+			t.Fatalf("Marshal(%v) = 0x%x, want 0x%x", v, got, want)
+		}
+	}
+}
+
+type money int64
+
+type point struct {
+	X, Y int
+}
+
+func TestTagSet(t *testing.T) {
+	var tags TagSet
+	tags.Add(reflect.TypeOf(money(0)), 1000)
+	tags.Add(reflect.TypeOf(point{}), 1001)
+	tags.Add(reflect.TypeOf(uint16(0)), 1002)
+	tests := []struct {
+		name string
+		v    interface{}
+		want []byte
+	}{
+		{"named int", money(5), hexDecode("d903e805")},
+		{"struct", point{1, 2}, hexDecode("d903e9820102")},
+		{"pointer", &point{1, 2}, hexDecode("d903e9820102")},
+		{"nil pointer", (*point)(nil), hexDecode("f6")},
+		{"builtin type", uint16(7), hexDecode("d903ea07")},
+		{"nested", map[string]interface{}{"a": []money{1}, "b": []*point{nil, {0, 0}}}, hexDecode("a2616181d903e801616282f6d903e9820000")},
+		{"unregistered", int8(1), hexDecode("01")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := Builder{Tags: &tags}
+			b.Marshal(tt.v)
+			if got, err := b.Bytes(); err != nil {
+				t.Errorf("Marshal(%v) returned error %v", tt.v, err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Errorf("Marshal(%v) = 0x%x, want 0x%x", tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeDecimal mimics third-party decimal types holding
+// the value coefficient*10^exp in unexported fields.
+type fakeDecimal struct {
+	coefficient *big.Int
+	exp         int32
+}
+
+func TestTagSetDecimal(t *testing.T) {
+	var tags TagSet
+	tags.AddDecimal(reflect.TypeOf(fakeDecimal{}), func(v interface{}) (int64, *big.Int) {
+		d := v.(fakeDecimal)
+		return int64(d.exp), d.coefficient
+	})
+	big1 := bigIntOrPanic("18446744073709551616")
+	tests := []struct {
+		name string
+		v    interface{}
+		want string
+	}{
+		{"decimal", fakeDecimal{big.NewInt(27315), -2}, "c48221196ab3"},
+		{"pointer", &fakeDecimal{big.NewInt(-5), 3}, "c4820324"},
+		{"bignum coefficient", fakeDecimal{&big1, 0}, "c48200c249010000000000000000"},
+		{"nested", map[string]interface{}{"a": []fakeDecimal{{big.NewInt(1), 1}}}, "a1616181c4820101"},
+		{"nil coefficient", fakeDecimal{}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := Builder{Tags: &tags}
+			b.Marshal(tt.v)
+			got, err := b.Bytes()
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("Marshal(%v) = 0x%x, want error", tt.v, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Marshal(%v) returned error %v", tt.v, err)
+			}
+			if !bytes.Equal(got, hexDecode(tt.want)) {
+				t.Errorf("Marshal(%v) = 0x%x, want 0x%s", tt.v, got, tt.want)
+			}
+		})
+	}
+
+	// Registering the type with a tag number replaces the decimal encoding.
+	tags.Add(reflect.TypeOf(fakeDecimal{}), 1000)
+	b := Builder{Tags: &tags}
+	b.Marshal(fakeDecimal{})
+	if got, err := b.Bytes(); err != nil || !bytes.Equal(got, hexDecode("d903e880")) {
+		t.Errorf("Marshal() = 0x%x, %v, want 0xd903e880", got, err)
+	}
+}
+
+func TestAddFloat16(t *testing.T) {
+	tests := []struct {
+		v    float16.Float16
+		want []byte
+	}{
+		{float16.Fromfloat32(1), hexDecode("f93c00")},
+		{float16.Fromfloat32(-4.1), hexDecode("f9c41a")},
+		{float16.Frombits(0x7e00), hexDecode("f97e00")}, // NaN
+		{float16.NaN(), hexDecode("f97e01")},
+		{float16.Inf(-1), hexDecode("f9fc00")},
+		{float16.Frombits(0x0001), hexDecode("f90001")},
+	}
+	for _, tt := range tests {
+		// The mode is ignored when encoding float16 values.
+		b := Builder{ModeFloat: ModeFloatNone, ModeNaN: ModeNaNReject}
+		b.AddFloat16(tt.v)
+		if got, err := b.Bytes(); err != nil {
+			t.Errorf("AddFloat16(%v) returned error %v", tt.v, err)
+		} else if !bytes.Equal(got, tt.want) {
+			t.Errorf("AddFloat16(%v) = 0x%x, want 0x%x", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestMarshalOmitZero(t *testing.T) {
+	type claims struct {
+		Expiry time.Time       `cbor:"exp,omitzero,keyasint=4"`
+		Count  int             `cbor:"count,omitzero"`
+		Nested struct{ A int } `cbor:"nested,omitzero"`
+	}
+	exp := time.Unix(1444064944, 0)
+	tests := []struct {
+		name string
+		v    interface{}
+		want []byte
+	}{
+		{"zero", claims{}, hexDecode("a0")},
+		// {4: 1(1444064944)}
+		{"expiry", claims{Expiry: exp}, hexDecode("a104c11a5612aeb0")},
+		// {4: 1(1444064944), "count": 1, "nested": [1]}
+		{"all", claims{Expiry: exp, Count: 1, Nested: struct{ A int }{1}}, hexDecode("a304c11a5612aeb065636f756e7401666e65737465648101")},
+		// The zero time.Time in UTC is omitted as well.
+		{"zero utc", claims{Expiry: time.Time{}.UTC()}, hexDecode("a0")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := Builder{ModeTime: ModeTimeUnix}
+			b.Marshal(tt.v)
+			if got, err := b.Bytes(); err != nil {
+				t.Errorf("Marshal(%v) returned error %v", tt.v, err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Errorf("Marshal(%v) = 0x%x, want 0x%x", tt.v, got, tt.want)
+			}
+		})
+	}
+
+	type invalid struct {
+		A int `cbor:"a,keyasint=x"`
+	}
+	if _, err := Marshal(invalid{}); err == nil {
+		t.Error("Marshal() with an invalid keyasint value returned no error")
+	}
+}
+
+func TestAddComplex128Array(t *testing.T) {
+	v := []complex128{complex(1, 2), complex(1.5, -1.1)}
+	tests := []struct {
+		name string
+		mode ModeComplexArray
+		v    interface{}
+		want []byte
+	}{
+		{"pairs", ModeComplexArrayPairs, v, hexDecode("8282f93c00f9400082f93e00fbbff199999999999a")},
+		{"interleaved", ModeComplexArrayInterleaved, v, hexDecode("84f93c00f94000f93e00fbbff199999999999a")},
+		{"nil", ModeComplexArrayPairs, []complex128(nil), hexDecode("f6")},
+		{"reflect", ModeComplexArrayPairs, struct{ C complex128 }{complex(1, 2)}, hexDecode("8182f93c00f94000")},
+		{"reflect complex64", ModeComplexArrayPairs, []complex64{complex(1, 2)}, hexDecode("8182f93c00f94000")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := Builder{ModeComplexArray: tt.mode}
+			b.Marshal(tt.v)
+			if got, err := b.Bytes(); err != nil {
+				t.Errorf("Marshal(%v) returned error %v", tt.v, err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Errorf("Marshal(%v) = 0x%x, want 0x%x", tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+func BenchmarkAddComplex128Array(b *testing.B) {
+	v := make([]complex128, 10000)
+	for i := range v {
+		v[i] = complex(float64(i)/3, -float64(i))
+	}
+	modes := []struct {
+		name string
+		mode ModeComplexArray
+	}{
+		{"pairs", ModeComplexArrayPairs},
+		{"interleaved", ModeComplexArrayInterleaved},
+	}
+	for _, m := range modes {
+		b.Run(m.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				bld := Builder{ModeComplexArray: m.mode}
+				bld.AddComplex128Array(v)
+				if _, err := bld.Bytes(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestAddSimpleValue(t *testing.T) {
+	tests := []struct {
+		v    uint8
+		want []byte
+	}{
+		{0, hexDecode("e0")},
+		{16, hexDecode("f0")},
+		{21, hexDecode("f5")},
+		{23, hexDecode("f7")},
+		{32, hexDecode("f820")},
+		{255, hexDecode("f8ff")},
+	}
+	for _, tt := range tests {
+		var b Builder
+		b.AddSimpleValue(tt.v)
+		if got, err := b.Bytes(); err != nil {
+			t.Errorf("AddSimpleValue(%d) returned error %v", tt.v, err)
+		} else if !bytes.Equal(got, tt.want) {
+			t.Errorf("AddSimpleValue(%d) = 0x%x, want 0x%x", tt.v, got, tt.want)
+		}
+	}
+
+	for _, v := range []uint8{24, 31} {
+		var b Builder
+		b.AddSimpleValue(v)
+		if _, err := b.Bytes(); err == nil {
+			t.Errorf("AddSimpleValue(%d) returned no error", v)
+		}
+	}
+}
+
+func TestModeTextCanonical(t *testing.T) {
+	tests := []struct {
+		name    string
+		fn      BuilderContinuation
+		want    []byte
+		wantErr bool
+	}{
+		{"valid", func(b *Builder) { b.Marshal("ü水") }, hexDecode("65c3bce6b0b4"), false},
+		{"long", func(b *Builder) { b.Marshal(strings.Repeat("a", 24)) }, append(hexDecode("7818"), strings.Repeat("a", 24)...), false},
+		{"empty", func(b *Builder) { b.Marshal("") }, hexDecode("60"), false},
+		{"invalid", func(b *Builder) { b.Marshal("\xff") }, nil, true},
+		{"overlong", func(b *Builder) { b.Marshal("\xc0\xaf") }, nil, true},
+		{"surrogate", func(b *Builder) { b.Marshal("\xed\xa0\x80") }, nil, true},
+		{"indefinite", func(b *Builder) {
+			b.AddStringIndefinite(func(b *Builder) { b.AddString("a") })
+		}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := Builder{ModeTextCanonical: true, ModeEmptyString: ModeEmptyStringNull}
+			tt.fn(&b)
+			got, err := b.Bytes()
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got 0x%x, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("returned error %v", err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Errorf("got 0x%x, want 0x%x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddBigInt(t *testing.T) {
+	pow64, _ := new(big.Int).SetString("18446744073709551616", 10)
+	large, _ := new(big.Int).SetString("-340282366920938463463374607431768211457", 10) // -2^128-1
+	tests := []struct {
+		name string
+		v    *big.Int
+		want []byte
+	}{
+		{"zero", big.NewInt(0), hexDecode("00")},
+		{"zero value", new(big.Int), hexDecode("00")},
+		{"small positive", big.NewInt(10), hexDecode("0a")},
+		{"minus one", big.NewInt(-1), hexDecode("20")},
+		{"small negative", big.NewInt(-500), hexDecode("3901f3")},
+		{"min negative uint64", new(big.Int).Neg(pow64), hexDecode("3bffffffffffffffff")},
+		{"leading zero bytes", new(big.Int).SetBytes(hexDecode("000000010000000000000000")), hexDecode("c249010000000000000000")},
+		{"max uint64", new(big.Int).SetUint64(math.MaxUint64), hexDecode("1bffffffffffffffff")},
+		{"just over uint64", pow64, hexDecode("c249010000000000000000")},
+		{"large negative", large, hexDecode("c3510100000000000000000000000000000000")},
+		{"nil", nil, hexDecode("f6")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b Builder
+			b.AddBigInt(tt.v)
+			if got, err := b.Bytes(); err != nil {
+				t.Errorf("AddBigInt(%v) returned error %v", tt.v, err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Errorf("AddBigInt(%v) = 0x%x, want 0x%x", tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddBigIntMinimal(t *testing.T) {
+	for n := uint(64); n <= 200; n++ {
+		for _, v := range []*big.Int{
+			new(big.Int).Lsh(big.NewInt(1), n),
+			new(big.Int).Neg(new(big.Int).Lsh(big.NewInt(1), n+1)),
+		} {
+			var b Builder
+			b.AddBigInt(v)
+			got, err := b.Bytes()
+			if err != nil {
+				t.Fatalf("AddBigInt(%v) returned error %v", v, err)
+			}
+			// Skip the tag and the byte string head.
+			major, l, size, err := readHead(got[1:])
+			if err != nil || major != cborTypeByteString || int(l) != len(got)-1-size {
+				t.Fatalf("AddBigInt(%v) = 0x%x, want a bignum", v, got)
+			}
+			if content := got[1+size:]; content[0] == 0 {
+				t.Errorf("AddBigInt(%v) = 0x%x, has a leading zero byte", v, got)
+			}
+			var bi big.Int
+			if err := Unmarshal(got, &bi); err != nil {
+				t.Errorf("Unmarshal(0x%x) returned error %v", got, err)
+			} else if bi.Cmp(v) != 0 {
+				t.Errorf("Unmarshal(0x%x) = %v, want %v", got, &bi, v)
+			}
+		}
+	}
+	if got, err := Marshal(*big.NewInt(0)); err != nil {
+		t.Errorf("Marshal(big.Int 0) returned error %v", err)
+	} else if want := hexDecode("00"); !bytes.Equal(got, want) {
+		t.Errorf("Marshal(big.Int 0) = 0x%x, want 0x%x", got, want)
+	}
+}
+
+func TestMarshalDeeplyNestedMap(t *testing.T) {
+	const depth = 1000
+	want := append(bytes.Repeat(hexDecode("a16161"), depth), 0x01)
+	tests := []struct {
+		name     string
+		maxDepth int
+		wantErr  bool
+	}{
+		{"no limit", 0, false},
+		// The innermost integer is one more level.
+		{"at limit", depth + 1, false},
+		{"over limit", depth, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := Builder{MaxNestingDepth: tt.maxDepth}
+			b.Marshal(nestedMap(depth))
+			got, err := b.Bytes()
+			if tt.wantErr {
+				if err == nil || err.Error() != "cbor: exceeded max nesting depth" {
+					t.Errorf("Marshal() returned error %v, want max nesting depth error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("Marshal() returned error %v", err)
+			} else if !bytes.Equal(got, want) {
+				t.Errorf("Marshal() = 0x%x, want 0x%x", got, want)
+			}
+		})
+	}
+}
+
+func TestMarshalTo(t *testing.T) {
+	dst := make([]byte, 2, 64)
+	dst[0], dst[1] = 0xaa, 0xbb
+	got, err := MarshalTo(dst, []int{1, 2})
+	if err != nil {
+		t.Fatalf("MarshalTo() returned error %v", err)
+	}
+	if want := hexDecode("aabb820102"); !bytes.Equal(got, want) {
+		t.Errorf("MarshalTo() = 0x%x, want 0x%x", got, want)
+	}
+	if &got[0] != &dst[0] {
+		t.Error("MarshalTo() didn't reuse the capacity of dst")
+	}
+
+	got, err = MarshalTo(nil, "a")
+	if err != nil {
+		t.Fatalf("MarshalTo(nil) returned error %v", err)
+	}
+	if want := hexDecode("6161"); !bytes.Equal(got, want) {
+		t.Errorf("MarshalTo(nil) = 0x%x, want 0x%x", got, want)
+	}
+
+	if _, err := MarshalTo(dst[:0], make(chan int)); err == nil {
+		t.Error("MarshalTo() of an unsupported type returned no error")
+	}
+}
+
+func TestSetLeadingSimpleValue(t *testing.T) {
+	var b Builder
+	b.SetLeadingSimpleValue(32)
+	b.Marshal(map[string]int{"v": 1})
+	want := hexDecode("f820a1617601")
+	if got, err := b.Bytes(); err != nil {
+		t.Errorf("Marshal() returned error %v", err)
+	} else if !bytes.Equal(got, want) {
+		t.Errorf("Marshal() = 0x%x, want 0x%x", got, want)
+	}
+
+	b = Builder{SelfDescribe: true}
+	b.SetLeadingSimpleValue(255)
+	b.Marshal([]int{1})
+	b.Marshal(2)
+	want = hexDecode("f8ffd9d9f7810102")
+	if got, _ := b.Bytes(); !bytes.Equal(got, want) {
+		t.Errorf("Marshal() with SelfDescribe = 0x%x, want 0x%x", got, want)
+	}
+
+	b.Reset()
+	b.Marshal(3)
+	want = hexDecode("f8ffd9d9f703")
+	if got, _ := b.Bytes(); !bytes.Equal(got, want) {
+		t.Errorf("Marshal() after Reset() = 0x%x, want 0x%x", got, want)
+	}
+
+	b = Builder{}
+	b.SetLeadingSimpleValue(24)
+	b.Marshal(1)
+	if _, err := b.Bytes(); err == nil {
+		t.Error("Marshal() with a reserved leading simple value returned no error")
+	}
+}
+
+func TestAddDecimalFraction(t *testing.T) {
+	large, _ := new(big.Int).SetString("-18446744073709551617", 10) // -2^64-1
+	tests := []struct {
+		name     string
+		mantissa *big.Int
+		exponent int64
+		want     []byte
+	}{
+		// 4([-2, 27315]), from RFC 8949 section 3.4.4.
+		{"273.15", big.NewInt(27315), -2, hexDecode("c48221196ab3")},
+		{"integer exponent", big.NewInt(-5), 3, hexDecode("c4820324")},
+		{"large mantissa", large, -10, hexDecode("c48229c349010000000000000000")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b Builder
+			b.AddDecimalFraction(tt.mantissa, tt.exponent)
+			if got, err := b.Bytes(); err != nil {
+				t.Errorf("AddDecimalFraction() returned error %v", err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Errorf("AddDecimalFraction() = 0x%x, want 0x%x", got, tt.want)
+			}
+		})
+	}
+
+	var b Builder
+	b.AddDecimalFraction(nil, 0)
+	if _, err := b.Bytes(); err == nil {
+		t.Error("AddDecimalFraction(nil) returned no error")
+	}
+}
+
+func TestMarshalRecordMaps(t *testing.T) {
+	tests := []struct {
+		name string
+		b    Builder
+		v    interface{}
+		want string
+	}{
+		{"nil", Builder{}, []map[string]interface{}(nil), "f6"},
+		{"nil map", Builder{}, map[string]interface{}(nil), "f6"},
+		{"empty", Builder{}, []map[string]interface{}{}, "80"},
+		{"nil record", Builder{}, []map[string]interface{}{nil, {}}, "82f6a0"},
+		{"sorted", Builder{}, []map[string]interface{}{{"bb": 1, "a": "x", "c": []int{2}}},
+			"81a3616161786163810262626201"},
+		{"map", Builder{}, map[string]interface{}{"b": true, "a": nil}, "a26161f66162f5"},
+		{"depth", Builder{MaxNestingDepth: 2}, []map[string]interface{}{{"a": 1}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.b
+			b.Marshal(tt.v)
+			got, err := b.Bytes()
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("got 0x%x, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, hexDecode(tt.want)) {
+				t.Errorf("got 0x%x, want 0x%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func BenchmarkMarshalRecordMaps(b *testing.B) {
+	v := make([]map[string]interface{}, 10000)
+	for i := range v {
+		m := make(map[string]interface{}, 10)
+		for j := 0; j < 10; j++ {
+			m["field"+strconv.Itoa(j)] = i * j
+		}
+		v[i] = m
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Marshal(v); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestMarshalUnsupported(t *testing.T) {
+	var nilFunc func()
+	var nilChan chan int
+	type fields struct {
+		F func()
+		C chan int
+	}
+	tests := []struct {
+		name string
+		mode ModeUnsupported
+		v    interface{}
+		want string
+	}{
+		{"nil chan error", ModeUnsupportedError, nilChan, ""},
+		{"nil func error", ModeUnsupportedError, nilFunc, ""},
+		{"nil chan null", ModeUnsupportedNilNull, nilChan, "f6"},
+		{"nil func null", ModeUnsupportedNilNull, nilFunc, "f6"},
+		{"nil chan undefined", ModeUnsupportedNilUndefined, nilChan, "f7"},
+		{"nil func undefined", ModeUnsupportedNilUndefined, nilFunc, "f7"},
+		{"chan null", ModeUnsupportedNilNull, make(chan int), ""},
+		{"chan undefined", ModeUnsupportedNilUndefined, make(chan int), ""},
+		{"func null", ModeUnsupportedNilNull, func() {}, ""},
+		{"fields", ModeUnsupportedNilUndefined, fields{}, "82f7f7"},
+		{"interface slice", ModeUnsupportedNilNull, []interface{}{nilChan, 1}, "82f601"},
+		{"fields error", ModeUnsupportedError, fields{}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := Builder{ModeUnsupported: tt.mode}
+			b.Marshal(tt.v)
+			got, err := b.Bytes()
+			if tt.want == "" {
+				if err == nil || !strings.HasPrefix(err.Error(), "cbor: invalid type") {
+					t.Fatalf("got 0x%x, %v, want invalid type error", got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, hexDecode(tt.want)) {
+				t.Errorf("got 0x%x, want 0x%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarshalRawMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		v    interface{}
+		want string
+	}{
+		{"item", RawMessage(hexDecode("83010203")), "83010203"},
+		{"nested", []interface{}{RawMessage(hexDecode("a161610a")), 1}, "82a161610a01"},
+		{"pointer", &struct{ M RawMessage }{RawMessage(hexDecode("f5"))}, "81f5"},
+		{"nil", RawMessage(nil), "f6"},
+		{"empty", RawMessage{}, ""},
+		{"truncated", RawMessage(hexDecode("8301")), ""},
+		{"two items", RawMessage(hexDecode("0101")), ""},
+		{"unexpected break", RawMessage(hexDecode("ff")), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Marshal(tt.v)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("Marshal(%v) = 0x%x, want error", tt.v, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Marshal(%v) returned error %v", tt.v, err)
+			}
+			if !bytes.Equal(got, hexDecode(tt.want)) {
+				t.Errorf("Marshal(%v) = 0x%x, want 0x%s", tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarshalEpochSeconds(t *testing.T) {
+	tests := []struct {
+		name string
+		v    EpochSeconds
+		want string
+	}{
+		{"nil", nil, "f6"},
+		{"empty", EpochSeconds{}, "d84340"},
+		{"times", EpochSeconds{
+			time.Unix(0, 0),
+			time.Unix(1363896240, 999999999).In(time.FixedZone("", 3600)),
+			time.Unix(1<<40+1, 0),
+		}, "d8435818" + "0000000000000000" + "00000000514b67b0" + "0000010000000001"},
+		{"before epoch", EpochSeconds{time.Unix(-1, 0)}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Marshal(tt.v)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("Marshal(%v) = 0x%x, want error", tt.v, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Marshal(%v) returned error %v", tt.v, err)
+			}
+			if !bytes.Equal(got, hexDecode(tt.want)) {
+				t.Errorf("Marshal(%v) = 0x%x, want 0x%s", tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarshalRegexp(t *testing.T) {
+	type rule struct {
+		Name    string         `cbor:"name"`
+		Pattern *regexp.Regexp `cbor:"pattern"`
+	}
+	re := regexp.MustCompile(`^a+b$`)
+	tests := []struct {
+		name string
+		b    Builder
+		v    interface{}
+		want string
+	}{
+		{"pointer", Builder{}, re, "d823655e612b6224"},
+		{"value", Builder{}, *re, "d823655e612b6224"},
+		{"nil", Builder{}, (*regexp.Regexp)(nil), "f6"},
+		{"field", Builder{}, rule{"r", re}, "a2646e616d656172677061747465726ed823655e612b6224"},
+		{"nil field", Builder{}, rule{"r", nil}, "a2646e616d656172677061747465726ef6"},
+		{"tag set", Builder{Tags: &TagSet{}}, []*regexp.Regexp{re, nil}, "82d823655e612b6224f6"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.b
+			b.Marshal(tt.v)
+			if got, err := b.Bytes(); err != nil {
+				t.Errorf("Marshal(%v) returned error %v", tt.v, err)
+			} else if !bytes.Equal(got, hexDecode(tt.want)) {
+				t.Errorf("Marshal(%v) = 0x%x, want 0x%s", tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarshalSequence(t *testing.T) {
+	got, err := MarshalSequence(1, "two", []int{3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := hexDecode("016374776f8103")
+	if !bytes.Equal(got, want) {
+		t.Errorf("MarshalSequence() = 0x%x, want 0x%x", got, want)
+	}
+	if got, err := MarshalSequence(); err != nil || len(got) != 0 {
+		t.Errorf("MarshalSequence() = 0x%x, %v, want an empty sequence", got, err)
+	}
+	if got, err := MarshalSequence(1, make(chan int), 2); err == nil {
+		t.Errorf("MarshalSequence() = 0x%x, want error", got)
+	}
+	// Each item is a well-formed data item.
+	dec := NewDecoder(bytes.NewReader(want))
+	for _, item := range []string{"01", "6374776f", "8103"} {
+		var raw RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(raw, hexDecode(item)) {
+			t.Errorf("Decode() = 0x%x, want 0x%s", raw, item)
+		}
+	}
+}
+
+func TestAddSequenceItem(t *testing.T) {
+	b := Builder{SelfDescribe: true}
+	b.AddSequenceItem(true)
+	b.AddSequenceItem(nil)
+	want := hexDecode("d9d9f7f5f6")
+	if got, err := b.Bytes(); err != nil || !bytes.Equal(got, want) {
+		t.Errorf("Bytes() = 0x%x, %v, want 0x%x", got, err, want)
+	}
+
+	b = Builder{}
+	b.AddMap(1)
+	b.AddMapItem(func(b *Builder) {
+		b.AddSequenceItem(1)
+	}, func(b *Builder) {
+		b.AddInt(2)
+	})
+	if got, err := b.Bytes(); err == nil {
+		t.Errorf("AddSequenceItem() inside a map = 0x%x, want error", got)
+	}
+}
+
+func TestModeIntWidth(t *testing.T) {
+	tests := []struct {
+		v        interface{}
+		shortest string
+		fixed    string
+	}{
+		{uint(1), "01", "1b0000000000000001"},
+		{uint8(200), "18c8", "1b00000000000000c8"},
+		{int16(-500), "3901f3", "3b00000000000001f3"},
+		{int32(1 << 20), "1a00100000", "1b0000000000100000"},
+		{int64(-1), "20", "3b0000000000000000"},
+		{uint64(math.MaxUint64), "1bffffffffffffffff", "1bffffffffffffffff"},
+		// Only integers are affected.
+		{[]int{1}, "8101", "811b0000000000000001"},
+		{Tag{1, "a"}, "c16161", "c16161"},
+		{bigIntOrPanic("18446744073709551616"), "c249010000000000000000", "c249010000000000000000"},
+		{map[string]int{"a": 2}, "a1616102", "a161611b0000000000000002"},
+	}
+	for _, tt := range tests {
+		for _, mode := range []struct {
+			mode ModeIntWidth
+			want string
+		}{{ModeIntWidthShortest, tt.shortest}, {ModeIntWidthFixed64, tt.fixed}} {
+			b := Builder{ModeIntWidth: mode.mode}
+			b.Marshal(tt.v)
+			if got, err := b.Bytes(); err != nil {
+				t.Errorf("Marshal(%v) returned error %v", tt.v, err)
+			} else if !bytes.Equal(got, hexDecode(mode.want)) {
+				t.Errorf("ModeIntWidth %d: Marshal(%v) = 0x%x, want 0x%s", mode.mode, tt.v, got, mode.want)
+			}
+		}
+	}
+}
+
+type color int
+
+func (c color) String() string {
+	return [...]string{"red", "green", "blue"}[c]
+}
+
+// version2 is a Stringer with a pointer receiver
+// whose distinct values can have the same string form.
+type version2 struct {
+	major, minor int
+}
+
+func (v *version2) String() string {
+	if v.minor == 0 {
+		return strconv.Itoa(v.major)
+	}
+	return strconv.Itoa(v.major) + "." + strconv.Itoa(v.minor)
+}
+
+func TestMarshalStringerKeys(t *testing.T) {
+	v1 := &version2{1, 0}
+	tests := []struct {
+		name string
+		b    Builder
+		v    interface{}
+		want string
+	}{
+		{"off", Builder{}, map[color]bool{0: true, 1: false}, "a200f501f4"},
+		// {"red": true, "blue": true, "green": false}
+		{"sorted", Builder{StringerKeys: true}, map[color]bool{0: true, 1: false, 2: true}, "a363726564f564626c7565f565677265656ef4"},
+		{"pointer receiver", Builder{StringerKeys: true}, map[version2]int{{1, 2}: 0}, "a163312e3200"},
+		{"pointer keys", Builder{StringerKeys: true}, map[*version2]int{v1: 0}, "a1613100"},
+		{"interface keys", Builder{StringerKeys: true}, map[interface{}]interface{}{color(2): 0, 1: 1}, "a2010164626c756500"},
+		{"non-stringer keys", Builder{StringerKeys: true}, map[int]int{1: 2}, "a10102"},
+		{"nil pointer key", Builder{StringerKeys: true}, map[*version2]int{nil: 0}, "a1f600"},
+		{"duplicate not detected", Builder{StringerKeys: true, ModeSort: ModeSortNone}, map[version2]int{{1, 0}: 0}, "a1613100"},
+		{"duplicate", Builder{StringerKeys: true, DetectDuplicateKeys: true}, map[interface{}]int{&version2{1, 0}: 0, v1: 1}, ""},
+		{"duplicate values", Builder{StringerKeys: true, DetectDuplicateKeys: true}, map[interface{}]int{version2{2, 0}: 0, &version2{2, 0}: 1}, ""},
+		{"no duplicate", Builder{StringerKeys: true, DetectDuplicateKeys: true}, map[interface{}]int{version2{2, 0}: 0, version2{2, 1}: 1}, "a261320063322e3101"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.b
+			b.Marshal(tt.v)
+			got, err := b.Bytes()
+			if tt.want == "" {
+				if err == nil || err.Error() != "cbor: duplicate map key" {
+					t.Fatalf("Marshal(%v) = 0x%x, %v, want duplicate map key error", tt.v, got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Marshal(%v) returned error %v", tt.v, err)
+			}
+			if !bytes.Equal(got, hexDecode(tt.want)) {
+				t.Errorf("Marshal(%v) = 0x%x, want 0x%s", tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChain(t *testing.T) {
+	var fluent Builder
+	fluent.Chain().Map(2, func(c Chain) {
+		c.Item(func(c Chain) { c.Str("a") }, func(c Chain) { c.Int(-5) }).
+			Item(func(c Chain) { c.Str("b") }, func(c Chain) {
+				c.Arr(6, func(c Chain) {
+					c.Uint(1).Str("hi").Bin([]byte{1}).Bool(true).Nil().Tag(1).Float(1.5)
+				})
+			})
+	}).Value([]int{7})
+	got, err := fluent.Bytes()
+	if err != nil {
+		t.Fatalf("Chain returned error %v", err)
+	}
+
+	var b Builder
+	b.AddMap(2)
+	b.AddMapItem(func(b *Builder) {
+		b.AddString("a")
+	}, func(b *Builder) {
+		b.AddInt(-5)
+	})
+	b.AddMapItem(func(b *Builder) {
+		b.AddString("b")
+	}, func(b *Builder) {
+		b.AddArray(6, func(b *Builder) {
+			b.AddUint(1)
+			b.AddString("hi")
+			b.AddBytes([]byte{1})
+			b.AddBool(true)
+			b.AddNil()
+			b.AddTag(1)
+			b.AddFloat64(1.5)
+		})
+	})
+	b.Marshal([]int{7})
+	want, err := b.Bytes()
+	if err != nil {
+		t.Fatalf("Bytes() returned error %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Chain = 0x%x, want 0x%x", got, want)
+	}
+	if c := fluent.Chain(); c.Builder() != &fluent {
+		t.Errorf("Chain().Builder() = %p, want %p", c.Builder(), &fluent)
+	}
+}
+
+func TestChainError(t *testing.T) {
+	var b Builder
+	_, err := b.Chain().Int(1).Value(make(chan int)).Int(2).Bytes()
+	if err == nil {
+		t.Error("Bytes() returned no error")
+	}
+}
+
+func TestModeNetIP(t *testing.T) {
+	v4 := netip.MustParseAddr("192.0.2.1")
+	v6 := netip.MustParseAddr("2001:db8::1")
+	mapped := netip.MustParseAddr("::ffff:192.0.2.1")
+	zoned := netip.MustParseAddr("fe80::1%eth0")
+	prefix4 := netip.MustParsePrefix("192.0.2.0/24")
+	prefix6 := netip.MustParsePrefix("2001:db8:1234::/48")
+	iface := netip.MustParsePrefix("192.0.2.1/24")
+	tests := []struct {
+		name string
+		mode ModeNetIP
+		v    interface{}
+		want []byte
+	}{
+		{"binary ipv4", ModeNetIPBinary, v4, hexDecode("44c0000201")},
+		{"binary ipv6", ModeNetIPBinary, v6, hexDecode("5020010db8000000000000000000000001")},
+		{"binary mapped", ModeNetIPBinary, mapped, hexDecode("5000000000000000000000ffffc0000201")},
+		{"binary zone", ModeNetIPBinary, zoned, hexDecode("54fe800000000000000000000000000001657468" + "30")},
+		{"binary prefix", ModeNetIPBinary, prefix4, hexDecode("45c000020018")},
+		{"text ipv4", ModeNetIPText, v4, hexDecode("693139322e302e322e31")},
+		{"text mapped", ModeNetIPText, &mapped, hexDecode("703a3a666666663a3139322e302e322e31")},
+		{"text zone", ModeNetIPText, zoned, hexDecode("6c666538303a3a3125657468" + "30")},
+		{"text prefix", ModeNetIPText, prefix4, hexDecode("6c3139322e302e322e302f3234")},
+		{"tag ipv4", ModeNetIPTag, v4, hexDecode("d83444c0000201")},
+		{"tag ipv6", ModeNetIPTag, v6, hexDecode("d8365020010db8000000000000000000000001")},
+		{"tag mapped", ModeNetIPTag, mapped, hexDecode("d8365000000000000000000000ffffc0000201")},
+		{"tag zone", ModeNetIPTag, zoned, hexDecode("d8368350fe800000000000000000000000000001f664657468" + "30")},
+		{"tag prefix ipv4", ModeNetIPTag, prefix4, hexDecode("d834821818" + "43c00002")},
+		{"tag prefix ipv6", ModeNetIPTag, prefix6, hexDecode("d836821830" + "4620010db81234")},
+		{"tag interface", ModeNetIPTag, iface, hexDecode("d8348244c00002011818")},
+		{"tag invalid", ModeNetIPTag, netip.Addr{}, hexDecode("f6")},
+		{"tag in struct", ModeNetIPTag, struct{ A netip.Addr }{v4}, hexDecode("81d83444c0000201")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := Builder{ModeNetIP: tt.mode}
+			b.Marshal(tt.v)
+			if got, err := b.Bytes(); err != nil {
+				t.Errorf("Marshal(%v) returned error %v", tt.v, err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Errorf("Marshal(%v) = 0x%x, want 0x%x", tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestModeSortNumeric(t *testing.T) {
+	numeric := Builder{ModeSort: ModeSortNumeric}
+	tests := []struct {
+		name string
+		b    Builder
+		v    interface{}
+		want []byte
+	}{
+		{"small", numeric, map[int]int{2: 2, 1: 1, 0: 0, -1: -1, -2: -2}, hexDecode("a521212020000001010202")},
+		{"mixed lengths", numeric, map[int64]int{300: 0, -1000: 1, 24: 2, -2: 3}, hexDecode("a43903e701210318180219012c00")},
+		{"fixed width", Builder{ModeSort: ModeSortNumeric, ModeIntWidth: ModeIntWidthFixed64}, map[int]int{1: 0, -1: 1},
+			hexDecode("a23b0000000000000000" + "1b0000000000000001" + "1b0000000000000001" + "1b0000000000000000")},
+		{"non-integer keys", numeric, map[interface{}]int{"a": 0, 1: 1, -1: 2, true: 3}, hexDecode("a420020101616100f503")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.b
+			b.Marshal(tt.v)
+			if got, err := b.Bytes(); err != nil {
+				t.Errorf("Marshal(%v) returned error %v", tt.v, err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Errorf("Marshal(%v) = 0x%x, want 0x%x", tt.v, got, tt.want)
+			}
+		})
+	}
+}
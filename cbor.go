@@ -1,8 +1,15 @@
 package cbor
 
 import (
+	"encoding"
+	"encoding/binary"
+	"errors"
 	"math/big"
+	"math/bits"
+	"net/netip"
 	"reflect"
+	"regexp"
+	"sort"
 	"time"
 )
 
@@ -22,6 +29,12 @@ type MarshalingValue interface {
 	MarshalCBORValue(*Builder) error
 }
 
+// A Marshaler returns its own CBOR encoding, which must be a single
+// well-formed data item as it is appended verbatim.
+type Marshaler interface {
+	MarshalCBOR() ([]byte, error)
+}
+
 type RawBytes []byte
 
 func (r RawBytes) MarshalCBORValue(b *Builder) error {
@@ -29,6 +42,26 @@ func (r RawBytes) MarshalCBORValue(b *Builder) error {
 	return nil
 }
 
+// RawMessage is a raw encoded CBOR data item, the CBOR analog of
+// json.RawMessage. It is encoded verbatim, like RawBytes, but encoding
+// it sets an error unless it holds exactly one well-formed data item.
+// A nil RawMessage is encoded as null. Unmarshal stores a copy of the
+// encoded data item in a RawMessage, which can be used to delay decoding
+// part of a message or to pass it through unchanged.
+type RawMessage []byte
+
+func (m RawMessage) MarshalCBORValue(b *Builder) error {
+	if m == nil {
+		b.AddNil()
+		return nil
+	}
+	if err := Valid(m); err != nil {
+		return err
+	}
+	b.AddRawBytes(m)
+	return nil
+}
+
 type Tag struct {
 	Number  uint64
 	Content interface{}
@@ -51,8 +84,133 @@ func (t RawTag) MarshalCBORValue(b *Builder) error {
 	return nil
 }
 
+// KeyValue is a single entry of a Map259.
+type KeyValue struct {
+	Key   interface{}
+	Value interface{}
+}
+
+// Map259 is a map with keys of any type, encoded as a map wrapped in
+// tag 259 as registered in the IANA CBOR tags registry.
+// Entries are sorted according to the Builder ModeSort, and are encoded
+// in slice order when it is ModeSortNone.
+type Map259 []KeyValue
+
+func (m Map259) MarshalCBORValue(b *Builder) error {
+	b.AddTag(259)
+	b.AddMap(len(m))
+	for _, kv := range m {
+		kv := kv
+		b.AddMapItem(func(b *Builder) {
+			b.Marshal(kv.Key)
+		}, func(b *Builder) {
+			b.Marshal(kv.Value)
+		})
+	}
+	return nil
+}
+
+// EpochSeconds is a series of times encoded as an RFC 8746 typed array of
+// big-endian uint64 (tag 67) holding the number of whole seconds elapsed
+// since the Unix epoch for each time, which is much more compact than
+// encoding each time on its own. Sub-second precision is discarded and
+// times before the epoch set an error. A nil EpochSeconds is encoded as null.
+type EpochSeconds []time.Time
+
+func (s EpochSeconds) MarshalCBORValue(b *Builder) error {
+	if s == nil {
+		b.AddNil()
+		return nil
+	}
+	for _, t := range s {
+		if t.Unix() < 0 {
+			return errors.New("cbor: cannot encode time before the Unix epoch as EpochSeconds")
+		}
+	}
+	addTypedArray(b, 67, 8, s, func(p []byte, t time.Time) {
+		binary.BigEndian.PutUint64(p, uint64(t.Unix()))
+	})
+	return nil
+}
+
+// Flags is a packed bitfield of up to 64 boolean flags indexed by position,
+// encoded as an unsigned integer whose bit i is set if flag i is true,
+// which takes at most 9 bytes. Encoding more than 64 flags sets an error.
+// Trailing false flags are not represented, so decoding returns the flags
+// up to the last true one, and Has reports false for any flag after it.
+type Flags []bool
+
+// Has reports whether flag i is set.
+func (f Flags) Has(i int) bool {
+	return i >= 0 && i < len(f) && f[i]
+}
+
+func (f Flags) MarshalCBORValue(b *Builder) error {
+	var n uint64
+	for i, v := range f {
+		if !v {
+			continue
+		}
+		if i >= 64 {
+			return errors.New("cbor: cannot encode more than 64 flags")
+		}
+		n |= 1 << i
+	}
+	b.AddUint64(n)
+	return nil
+}
+
+func (f *Flags) UnmarshalCBORValue(data []byte) error {
+	var n uint64
+	if err := Unmarshal(data, &n); err != nil {
+		return err
+	}
+	*f = make(Flags, bits.Len64(n))
+	for i := range *f {
+		(*f)[i] = n&(1<<i) != 0
+	}
+	return nil
+}
+
+// FlagSet is a set of flags encoded as a set (tag 258) holding an array of
+// the keys whose value is true. The keys are sorted as their deterministic
+// encodings, which for text strings means shorter keys first and keys of
+// the same length in lexical order, regardless of ModeSort.
+type FlagSet map[string]bool
+
+func (f FlagSet) MarshalCBORValue(b *Builder) error {
+	keys := make([]string, 0, len(f))
+	for k, v := range f {
+		if v {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if len(keys[i]) != len(keys[j]) {
+			return len(keys[i]) < len(keys[j])
+		}
+		return keys[i] < keys[j]
+	})
+	b.AddTag(258)
+	b.AddArray(uint64(len(keys)), func(b *Builder) {
+		for _, k := range keys {
+			b.AddString(k)
+		}
+	})
+	return nil
+}
+
 var (
 	typeMarshalingValue = reflect.TypeOf((*MarshalingValue)(nil)).Elem()
+	typeError           = reflect.TypeOf((*error)(nil)).Elem()
+	typeMarshaler       = reflect.TypeOf((*Marshaler)(nil)).Elem()
+	typeBinaryMarshaler = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+	typeTextMarshaler   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
 	typeBigInt          = reflect.TypeOf(big.Int{})
+	typeBigFloat        = reflect.TypeOf(big.Float{})
+	typeBigRat          = reflect.TypeOf(big.Rat{})
 	typeTime            = reflect.TypeOf(time.Time{})
+	typeRegexp          = reflect.TypeOf(regexp.Regexp{})
+	typeNetIPAddr       = reflect.TypeOf(netip.Addr{})
+	typeNetIPPrefix     = reflect.TypeOf(netip.Prefix{})
 )
@@ -0,0 +1,110 @@
+package cbor
+
+// Chain wraps a Builder with methods that append to it and return the
+// Chain, so that a document can be built in a single expression:
+//
+//	c := b.Chain()
+//	c.Arr(2, func(c Chain) {
+//		c.Int(5).Str("hi")
+//	})
+//
+// Errors are set on the wrapped Builder as usual and reported by Bytes.
+type Chain struct {
+	b *Builder
+}
+
+// Chain returns a Chain appending to b.
+func (b *Builder) Chain() Chain {
+	return Chain{b}
+}
+
+// Builder returns the Builder wrapped by c.
+func (c Chain) Builder() *Builder {
+	return c.b
+}
+
+// Bytes returns the bytes written by the wrapped Builder or an error
+// if one has occurred during building.
+func (c Chain) Bytes() ([]byte, error) {
+	return c.b.Bytes()
+}
+
+// Nil appends null.
+func (c Chain) Nil() Chain {
+	c.b.AddNil()
+	return c
+}
+
+// Bool appends v as a boolean.
+func (c Chain) Bool(v bool) Chain {
+	c.b.AddBool(v)
+	return c
+}
+
+// Int appends v as an integer.
+func (c Chain) Int(v int64) Chain {
+	c.b.AddInt64(v)
+	return c
+}
+
+// Uint appends v as an unsigned integer.
+func (c Chain) Uint(v uint64) Chain {
+	c.b.AddUint64(v)
+	return c
+}
+
+// Float appends v as a float, as specified by ModeFloat.
+func (c Chain) Float(v float64) Chain {
+	c.b.AddFloat64(v)
+	return c
+}
+
+// Str appends v as a text string.
+func (c Chain) Str(v string) Chain {
+	c.b.AddString(v)
+	return c
+}
+
+// Bin appends v as a byte string.
+func (c Chain) Bin(v []byte) Chain {
+	c.b.AddBytes(v)
+	return c
+}
+
+// Tag appends the tag number, which must be followed by the tagged value.
+func (c Chain) Tag(number uint64) Chain {
+	c.b.AddTag(number)
+	return c
+}
+
+// Value appends the encoding of v, as Builder.Marshal does.
+func (c Chain) Value(v interface{}) Chain {
+	c.b.Marshal(v)
+	return c
+}
+
+// Arr appends an array of n items, which are appended by fn.
+func (c Chain) Arr(n uint64, fn func(Chain)) Chain {
+	c.b.AddArray(n, func(b *Builder) {
+		fn(Chain{b})
+	})
+	return c
+}
+
+// Map appends a map of n items, which are appended by fn with Item.
+func (c Chain) Map(n int, fn func(Chain)) Chain {
+	c.b.AddMap(n)
+	fn(c)
+	return c
+}
+
+// Item appends an item to the map started by the last Map call,
+// with its key appended by k and its value by v.
+func (c Chain) Item(k, v func(Chain)) Chain {
+	c.b.AddMapItem(func(b *Builder) {
+		k(Chain{b})
+	}, func(b *Builder) {
+		v(Chain{b})
+	})
+	return c
+}
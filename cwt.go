@@ -0,0 +1,38 @@
+package cbor
+
+import "time"
+
+// NumericDate is a time encoded as the number of seconds elapsed since
+// the Unix epoch without the leading tag 1, as defined by RFC 8392 section 2.
+// The content is an integer if the time has no sub-second component,
+// else a float64.
+type NumericDate time.Time
+
+func (d NumericDate) MarshalCBORValue(b *Builder) error {
+	t := time.Time(d)
+	if t.Nanosecond() == 0 {
+		b.AddInt64(t.Unix())
+	} else {
+		b.AddFloat64(unixFloat(t))
+	}
+	return nil
+}
+
+// IsZero reports whether d is the zero time, so that a NumericDate
+// struct field with the omitzero option is omitted when unset.
+func (d NumericDate) IsZero() bool {
+	return time.Time(d).IsZero()
+}
+
+// CWTClaims holds the claims of a CBOR Web Token registered by
+// RFC 8392 section 3.1, encoded as a map keyed by the claim keys.
+// Unset claims are omitted.
+type CWTClaims struct {
+	Issuer     string       `cbor:"1,keyasint,omitempty"`
+	Subject    string       `cbor:"2,keyasint,omitempty"`
+	Audience   string       `cbor:"3,keyasint,omitempty"`
+	Expiration *NumericDate `cbor:"4,keyasint,omitempty"`
+	NotBefore  *NumericDate `cbor:"5,keyasint,omitempty"`
+	IssuedAt   *NumericDate `cbor:"6,keyasint,omitempty"`
+	CWTID      []byte       `cbor:"7,keyasint,omitempty"`
+}
@@ -0,0 +1,1050 @@
+package cbor
+
+import (
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/big"
+	"reflect"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/x448/float16"
+)
+
+var (
+	errUnexpectedEnd = errors.New("cbor: unexpected end of data")
+	errReservedInfo  = errors.New("cbor: reserved additional information")
+
+	// errIndefinite is returned by readHead for the head of an
+	// indefinite-length item or a break, which has no argument.
+	errIndefinite = errors.New("cbor: indefinite length")
+
+	errInvalidIndefinite = errors.New("cbor: unexpected break or indefinite length")
+	errInvalidChunk      = errors.New("cbor: invalid chunk in indefinite-length string")
+	errInvalidUTF8       = errors.New("cbor: invalid UTF-8 text string")
+	errInvalidSimple     = errors.New("cbor: invalid two-byte simple value")
+)
+
+var (
+	typeUnmarshalingValue = reflect.TypeOf((*UnmarshalingValue)(nil)).Elem()
+	typeBinaryUnmarshaler = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+	typeTextUnmarshaler   = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	typeRawBytes          = reflect.TypeOf(RawBytes(nil))
+	typeRawMessage        = reflect.TypeOf(RawMessage(nil))
+	typeTag               = reflect.TypeOf(Tag{})
+	typeRawTag            = reflect.TypeOf(RawTag{})
+)
+
+// readHead parses the head of the data item at the start of data.
+// majorType is one of the cborType constants and argument is the value
+// encoded in the head, which is headLen bytes long.
+// If the head has additional information 31, it returns errIndefinite
+// with a headLen of 1, and the caller decides whether it is allowed.
+func readHead(data []byte) (majorType byte, argument uint64, headLen int, err error) {
+	if len(data) == 0 {
+		return 0, 0, 0, errUnexpectedEnd
+	}
+	majorType = data[0] & 0xe0
+	info := data[0] & 0x1f
+	switch {
+	case info < 24:
+		return majorType, uint64(info), 1, nil
+	case info == 31:
+		return majorType, 0, 1, errIndefinite
+	case info > 27:
+		return majorType, 0, 0, errReservedInfo
+	}
+	headLen = 1 + 1<<(info-24)
+	if len(data) < headLen {
+		return majorType, 0, 0, errUnexpectedEnd
+	}
+	switch info {
+	case 24:
+		argument = uint64(data[1])
+	case 25:
+		argument = uint64(binary.BigEndian.Uint16(data[1:]))
+	case 26:
+		argument = uint64(binary.BigEndian.Uint32(data[1:]))
+	case 27:
+		argument = binary.BigEndian.Uint64(data[1:])
+	}
+	return majorType, argument, headLen, nil
+}
+
+// Unmarshal decodes the CBOR data item in data and stores the result in
+// the value pointed to by v, which must be a non-nil pointer.
+// It is an error if data holds anything after the data item.
+//
+// Values implementing UnmarshalingValue are decoded by UnmarshalCBORValue,
+// which receives a copy of the encoded data item, including null.
+// Otherwise, reflection is used.
+//
+// Values are decoded according to the kind of the destination, reversing
+// the rules of Marshal: integers into integer kinds that can hold them,
+// floats into float kinds, byte strings into byte slices and arrays, text
+// strings into strings, arrays into slices, arrays and structs, and maps
+// into maps and structs, matching struct fields by the keys they are
+// encoded with. Null and undefined set pointers, interfaces, maps and
+// slices to nil and leave other values unchanged. Pointers are allocated
+// as needed.
+//
+// Tags 0 and 1 are decoded into time.Time, tags 2 and 3 into big.Int,
+// and any tag into Tag and RawTag. Other tags are ignored and their
+// content is decoded into the destination. RawBytes and RawMessage
+// receive a copy of the encoded data item. Byte and text strings are
+// decoded into values implementing encoding.BinaryUnmarshaler and
+// encoding.TextUnmarshaler.
+//
+// An empty interface receives uint64 for positive integers, int64 for
+// negative integers, or a big.Int if they don't fit, float64, bool,
+// []byte, string, []interface{}, map[interface{}]interface{},
+// big.Int for bignums, Tag for other tags, and nil for null and undefined.
+//
+// Unmarshal uses the default limits of DecodeOptions.
+func Unmarshal(data []byte, v interface{}) error {
+	return DecodeOptions{}.Unmarshal(data, v)
+}
+
+// Default limits used by DecodeOptions.
+const (
+	DefaultMaxArrayElements = 131072
+	DefaultMaxMapPairs      = 131072
+	DefaultMaxStringBytes   = 16 << 20
+	DefaultMaxNestedLevels  = 1024
+)
+
+// DecodeOptions holds limits that protect the decoder from untrusted input
+// claiming huge lengths, which are checked before allocating anything for
+// the data item. Exceeding a limit makes decoding return an error.
+// A zero limit means its default value and a negative one means no limit.
+type DecodeOptions struct {
+	// MaxArrayElements limits the number of elements of an array.
+	// It defaults to DefaultMaxArrayElements.
+	MaxArrayElements int
+
+	// MaxMapPairs limits the number of key-value pairs of a map.
+	// It defaults to DefaultMaxMapPairs.
+	MaxMapPairs int
+
+	// MaxStringBytes limits the length in bytes of a byte or text string,
+	// including the total length of the chunks of an indefinite-length one.
+	// It defaults to DefaultMaxStringBytes.
+	MaxStringBytes int
+
+	// MaxNestedLevels limits how deeply arrays, maps and tags can be nested,
+	// so that deeply nested input can't exhaust the stack. A top-level
+	// array is one level deep. It defaults to DefaultMaxNestedLevels.
+	MaxNestedLevels int
+}
+
+// Unmarshal is like the Unmarshal function but enforces the limits of o.
+func (o DecodeOptions) Unmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("cbor: Unmarshal requires a non-nil pointer")
+	}
+	d := decodeState{data: data, decodeLimits: o.limits()}
+	if err := d.value(rv.Elem()); err != nil {
+		return err
+	}
+	if d.off != len(data) {
+		return errExtraneousData
+	}
+	return nil
+}
+
+// An UnmarshalingValue decodes a data item into itself, the counterpart
+// of MarshalingValue. data holds exactly one encoded data item, which
+// UnmarshalCBORValue can keep as it is a copy. It is usually implemented
+// with a pointer receiver and decodes data with Unmarshal.
+type UnmarshalingValue interface {
+	UnmarshalCBORValue(data []byte) error
+}
+
+// decodeLimits holds the limits in effect, where 0 means no limit.
+type decodeLimits struct {
+	maxArrayElements int
+	maxMapPairs      int
+	maxStringBytes   int
+	maxNestedLevels  int
+}
+
+func (o DecodeOptions) limits() decodeLimits {
+	limit := func(n, def int) int {
+		switch {
+		case n == 0:
+			return def
+		case n < 0:
+			return 0
+		}
+		return n
+	}
+	return decodeLimits{
+		maxArrayElements: limit(o.MaxArrayElements, DefaultMaxArrayElements),
+		maxMapPairs:      limit(o.MaxMapPairs, DefaultMaxMapPairs),
+		maxStringBytes:   limit(o.MaxStringBytes, DefaultMaxStringBytes),
+		maxNestedLevels:  limit(o.MaxNestedLevels, DefaultMaxNestedLevels),
+	}
+}
+
+// check returns an error if n exceeds the limit for
+// the length of items of the given major type.
+func (l *decodeLimits) check(major byte, n uint64) error {
+	var max int
+	var name string
+	switch major {
+	case cborTypeByteString, cborTypeTextString:
+		max, name = l.maxStringBytes, "string exceeds MaxStringBytes"
+	case cborTypeArray:
+		max, name = l.maxArrayElements, "array exceeds MaxArrayElements"
+	case cborTypeMap:
+		max, name = l.maxMapPairs, "map exceeds MaxMapPairs"
+	default:
+		return nil
+	}
+	if max > 0 && n > uint64(max) {
+		return errors.New("cbor: " + name + " (" + strconv.Itoa(max) + ")")
+	}
+	return nil
+}
+
+// nest returns an error if an array, a map or a tag nested depth levels
+// deep, counting itself, exceeds the nesting limit.
+func (l *decodeLimits) nest(depth int) error {
+	if l.maxNestedLevels > 0 && depth > l.maxNestedLevels {
+		return errors.New("cbor: data item exceeds MaxNestedLevels (" + strconv.Itoa(l.maxNestedLevels) + ")")
+	}
+	return nil
+}
+
+// decodeState holds the data being decoded, the offset
+// of the next data item and the limits in effect.
+type decodeState struct {
+	data []byte
+	off  int
+	// depth is the number of arrays, maps and tags being decoded.
+	depth int
+	decodeLimits
+}
+
+// enter increments the nesting depth before decoding the content of an
+// array, a map or a tag, returning an error if it exceeds MaxNestedLevels.
+// Every call that returns nil must be paired with a call to leave.
+func (d *decodeState) enter() error {
+	if err := d.nest(d.depth + 1); err != nil {
+		return err
+	}
+	d.depth++
+	return nil
+}
+
+func (d *decodeState) leave() {
+	d.depth--
+}
+
+// head reads the head of the next data item. info is its additional
+// information, which is 31 for indefinite-length strings, arrays and maps.
+func (d *decodeState) head() (major, info byte, arg uint64, err error) {
+	major, arg, n, err := readHead(d.data[d.off:])
+	if err == errIndefinite {
+		switch major {
+		case cborTypeByteString, cborTypeTextString, cborTypeArray, cborTypeMap:
+			err = nil
+		default:
+			err = errInvalidIndefinite
+		}
+	}
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	info = d.data[d.off] & 0x1f
+	if major == cborTypePrimitives && info == 24 && arg < 32 {
+		// Simple values below 32 only have the one-byte form.
+		return 0, 0, 0, errInvalidSimple
+	}
+	if info != 31 {
+		if err := d.check(major, arg); err != nil {
+			return 0, 0, 0, err
+		}
+	}
+	d.off += n
+	return major, info, arg, nil
+}
+
+// more reports whether the array or map whose head had the given
+// major type, additional information and argument has an element after
+// the first i, consuming the break that ends indefinite-length items.
+func (d *decodeState) more(major byte, i uint64, info byte, arg uint64) (bool, error) {
+	if info != 31 {
+		return i < arg, nil
+	}
+	if d.off >= len(d.data) {
+		return false, errUnexpectedEnd
+	}
+	if d.data[d.off] == cborBreak {
+		d.off++
+		return false, nil
+	}
+	return true, d.check(major, i+1)
+}
+
+// length returns the length of the array or map whose head had the given
+// additional information and argument, or 0 for indefinite-length items.
+// Each element takes at least a byte, so longer lengths are truncated data.
+func (d *decodeState) length(info byte, arg uint64) (int, error) {
+	if info == 31 {
+		return 0, nil
+	}
+	if arg > uint64(len(d.data)-d.off) {
+		return 0, errUnexpectedEnd
+	}
+	return int(arg), nil
+}
+
+// str returns the content of the byte or text string with the given head,
+// concatenating the chunks of indefinite-length strings.
+// The content of definite-length strings aliases the data.
+func (d *decodeState) str(major, info byte, arg uint64) ([]byte, error) {
+	if info != 31 {
+		if arg > uint64(len(d.data)-d.off) {
+			return nil, errUnexpectedEnd
+		}
+		s := d.data[d.off : d.off+int(arg)]
+		d.off += int(arg)
+		return s, nil
+	}
+	s := []byte{}
+	for {
+		if d.off >= len(d.data) {
+			return nil, errUnexpectedEnd
+		}
+		if d.data[d.off] == cborBreak {
+			d.off++
+			return s, nil
+		}
+		if c := d.data[d.off]; c&0xe0 != major || c&0x1f == 31 {
+			return nil, errInvalidChunk
+		}
+		_, info, arg, err := d.head()
+		if err != nil {
+			return nil, err
+		}
+		chunk, err := d.str(major, info, arg)
+		if err != nil {
+			return nil, err
+		}
+		s = append(s, chunk...)
+		if err := d.check(major, uint64(len(s))); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// text is like str but validates that the content is UTF-8.
+func (d *decodeState) text(info byte, arg uint64) (string, error) {
+	s, err := d.str(cborTypeTextString, info, arg)
+	if err != nil {
+		return "", err
+	}
+	if !utf8.Valid(s) {
+		return "", errInvalidUTF8
+	}
+	return string(s), nil
+}
+
+// skip skips the next data item.
+func (d *decodeState) skip() error {
+	major, info, arg, err := d.head()
+	if err != nil {
+		return err
+	}
+	switch major {
+	case cborTypeByteString, cborTypeTextString:
+		_, err = d.str(major, info, arg)
+		return err
+	case cborTypeArray, cborTypeMap:
+		if err := d.enter(); err != nil {
+			return err
+		}
+		defer d.leave()
+		for i := uint64(0); ; i++ {
+			ok, err := d.more(major, i, info, arg)
+			if err != nil || !ok {
+				return err
+			}
+			if err := d.skip(); err != nil {
+				return err
+			}
+			if major == cborTypeMap {
+				if err := d.skip(); err != nil {
+					return err
+				}
+			}
+		}
+	case cborTypeTag:
+		if err := d.enter(); err != nil {
+			return err
+		}
+		defer d.leave()
+		return d.skip()
+	}
+	return nil
+}
+
+// raw skips the next data item and returns a copy of its encoding.
+func (d *decodeState) raw() ([]byte, error) {
+	start := d.off
+	if err := d.skip(); err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), d.data[start:d.off]...), nil
+}
+
+// any decodes the next data item into the value Unmarshal
+// stores in an empty interface.
+func (d *decodeState) any() (interface{}, error) {
+	major, info, arg, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	if major == cborTypeArray || major == cborTypeMap || major == cborTypeTag {
+		if err := d.enter(); err != nil {
+			return nil, err
+		}
+		defer d.leave()
+	}
+	switch major {
+	case cborTypePositiveInt:
+		return arg, nil
+	case cborTypeNegativeInt:
+		if arg <= math.MaxInt64 {
+			return -1 - int64(arg), nil
+		}
+		return *negativeBigInt(new(big.Int).SetUint64(arg)), nil
+	case cborTypeByteString:
+		s, err := d.str(major, info, arg)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{}, s...), nil
+	case cborTypeTextString:
+		return d.text(info, arg)
+	case cborTypeArray:
+		n, err := d.length(info, arg)
+		if err != nil {
+			return nil, err
+		}
+		a := make([]interface{}, 0, n)
+		for i := uint64(0); ; i++ {
+			ok, err := d.more(major, i, info, arg)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return a, nil
+			}
+			x, err := d.any()
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, x)
+		}
+	case cborTypeMap:
+		n, err := d.length(info, arg)
+		if err != nil {
+			return nil, err
+		}
+		m := make(map[interface{}]interface{}, n)
+		for i := uint64(0); ; i++ {
+			ok, err := d.more(major, i, info, arg)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return m, nil
+			}
+			k, err := d.any()
+			if err != nil {
+				return nil, err
+			}
+			if !hashable(reflect.ValueOf(k)) {
+				return nil, errors.New("cbor: invalid map key type " + reflect.TypeOf(k).String())
+			}
+			x, err := d.any()
+			if err != nil {
+				return nil, err
+			}
+			m[k] = x
+		}
+	case cborTypeTag:
+		if (arg == 2 || arg == 3) && d.off < len(d.data) && d.data[d.off]&0xe0 == cborTypeByteString {
+			x, err := d.bignum(arg)
+			if err != nil {
+				return nil, err
+			}
+			return *x, nil
+		}
+		content, err := d.any()
+		if err != nil {
+			return nil, err
+		}
+		return Tag{arg, content}, nil
+	}
+	switch {
+	case info >= 25 && info <= 27:
+		return floatValue(info, arg), nil
+	case arg == 20 || arg == 21:
+		return arg == 21, nil
+	case arg == 22 || arg == 23:
+		return nil, nil
+	}
+	return nil, errors.New("cbor: cannot unmarshal simple value " + strconv.FormatUint(arg, 10))
+}
+
+// floatValue returns the value of the float whose head had
+// additional information info, 25 to 27, and argument arg.
+func floatValue(info byte, arg uint64) float64 {
+	switch info {
+	case 25:
+		return float64(float16.Frombits(uint16(arg)).Float32())
+	case 26:
+		return float64(math.Float32frombits(uint32(arg)))
+	}
+	return math.Float64frombits(arg)
+}
+
+// bignum decodes the byte string content of a bignum with tag number num,
+// which is 2 or 3.
+func (d *decodeState) bignum(num uint64) (*big.Int, error) {
+	major, info, arg, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	if major != cborTypeByteString {
+		return nil, errors.New("cbor: invalid bignum content")
+	}
+	s, err := d.str(major, info, arg)
+	if err != nil {
+		return nil, err
+	}
+	x := new(big.Int).SetBytes(s)
+	if num == 3 {
+		negativeBigInt(x)
+	}
+	return x, nil
+}
+
+// negativeBigInt sets x to -1-x and returns it.
+func negativeBigInt(x *big.Int) *big.Int {
+	return x.Neg(x.Add(x, big.NewInt(1)))
+}
+
+// hashable reports whether v can be used as a map key.
+func hashable(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Interface:
+		return v.IsNil() || hashable(v.Elem())
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if !hashable(v.Field(i)) {
+				return false
+			}
+		}
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if !hashable(v.Index(i)) {
+				return false
+			}
+		}
+	case reflect.Slice, reflect.Map, reflect.Func:
+		return false
+	}
+	return true
+}
+
+// unmarshalTypeError returns the error for a data item of the given major type
+// that can't be decoded into a value of type t.
+func unmarshalTypeError(major byte, t reflect.Type) error {
+	var name string
+	switch major {
+	case cborTypePositiveInt:
+		name = "positive integer"
+	case cborTypeNegativeInt:
+		name = "negative integer"
+	case cborTypeByteString:
+		name = "byte string"
+	case cborTypeTextString:
+		name = "text string"
+	case cborTypeArray:
+		name = "array"
+	case cborTypeMap:
+		name = "map"
+	case cborTypeTag:
+		name = "tag"
+	default:
+		name = "primitive"
+	}
+	return errors.New("cbor: cannot unmarshal " + name + " into Go value of type " + t.String())
+}
+
+// value decodes the next data item into v.
+func (d *decodeState) value(v reflect.Value) error {
+	if d.off >= len(d.data) {
+		return errUnexpectedEnd
+	}
+	t := v.Type()
+	if t == typeRawBytes || t == typeRawMessage {
+		raw, err := d.raw()
+		if err != nil {
+			return err
+		}
+		v.SetBytes(raw)
+		return nil
+	}
+	null := d.data[d.off] == cborNil || d.data[d.off] == cborUndefined
+	if null {
+		switch v.Kind() {
+		case reflect.Interface, reflect.Ptr, reflect.Map, reflect.Slice:
+			d.off++
+			v.Set(reflect.Zero(t))
+			return nil
+		}
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(t.Elem()))
+		}
+		return d.value(v.Elem())
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return unmarshalTypeError(d.data[d.off]&0xe0, t)
+		}
+		x, err := d.any()
+		if err != nil {
+			return err
+		}
+		if x == nil {
+			v.Set(reflect.Zero(t))
+		} else {
+			v.Set(reflect.ValueOf(x))
+		}
+		return nil
+	}
+	if v.CanAddr() && v.Addr().Type().Implements(typeUnmarshalingValue) {
+		raw, err := d.raw()
+		if err != nil {
+			return err
+		}
+		return v.Addr().Interface().(UnmarshalingValue).UnmarshalCBORValue(raw)
+	}
+	if null {
+		d.off++
+		return nil
+	}
+	switch t {
+	case typeTag, typeRawTag:
+		major, _, arg, err := d.head()
+		if err != nil {
+			return err
+		}
+		if major != cborTypeTag {
+			return unmarshalTypeError(major, t)
+		}
+		if err := d.enter(); err != nil {
+			return err
+		}
+		defer d.leave()
+		v.Field(0).SetUint(arg)
+		return d.value(v.Field(1))
+	case typeBigInt:
+		return d.bigInt(v)
+	case typeTime:
+		return d.time(v)
+	}
+	if v.CanAddr() {
+		if ok, err := d.unmarshaler(v.Addr()); ok {
+			return err
+		}
+	}
+	major, info, arg, err := d.head()
+	if err != nil {
+		return err
+	}
+	if major == cborTypeArray || major == cborTypeMap || major == cborTypeTag {
+		if err := d.enter(); err != nil {
+			return err
+		}
+		defer d.leave()
+	}
+	switch major {
+	case cborTypePositiveInt:
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if arg > math.MaxInt64 || v.OverflowInt(int64(arg)) {
+				return overflowError(t)
+			}
+			v.SetInt(int64(arg))
+			return nil
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			if v.OverflowUint(arg) {
+				return overflowError(t)
+			}
+			v.SetUint(arg)
+			return nil
+		}
+	case cborTypeNegativeInt:
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if arg > math.MaxInt64 || v.OverflowInt(-1-int64(arg)) {
+				return overflowError(t)
+			}
+			v.SetInt(-1 - int64(arg))
+			return nil
+		}
+	case cborTypeByteString:
+		if (v.Kind() != reflect.Slice && v.Kind() != reflect.Array) || t.Elem().Kind() != reflect.Uint8 {
+			break
+		}
+		s, err := d.str(major, info, arg)
+		if err != nil {
+			return err
+		}
+		if v.Kind() == reflect.Slice {
+			v.SetBytes(append([]byte{}, s...))
+			return nil
+		}
+		if len(s) != v.Len() {
+			return errors.New("cbor: cannot unmarshal byte string of length " + strconv.Itoa(len(s)) + " into Go value of type " + t.String())
+		}
+		for i, c := range s {
+			v.Index(i).SetUint(uint64(c))
+		}
+		return nil
+	case cborTypeTextString:
+		if v.Kind() != reflect.String {
+			break
+		}
+		s, err := d.text(info, arg)
+		if err != nil {
+			return err
+		}
+		v.SetString(s)
+		return nil
+	case cborTypeArray:
+		switch v.Kind() {
+		case reflect.Slice, reflect.Array:
+			return d.array(v, info, arg)
+		case reflect.Struct:
+			return d.structArray(v, info, arg)
+		}
+	case cborTypeMap:
+		switch v.Kind() {
+		case reflect.Map:
+			return d.mapValue(v, info, arg)
+		case reflect.Struct:
+			return d.structMap(v, info, arg)
+		}
+	case cborTypeTag:
+		// Tags without a Go type of their own are ignored.
+		return d.value(v)
+	case cborTypePrimitives:
+		switch {
+		case info >= 25 && info <= 27:
+			if v.Kind() != reflect.Float32 && v.Kind() != reflect.Float64 {
+				break
+			}
+			f := floatValue(info, arg)
+			if !math.IsInf(f, 0) && v.OverflowFloat(f) {
+				return overflowError(t)
+			}
+			v.SetFloat(f)
+			return nil
+		case arg == 20 || arg == 21:
+			if v.Kind() == reflect.Bool {
+				v.SetBool(arg == 21)
+				return nil
+			}
+		}
+	}
+	return unmarshalTypeError(major, t)
+}
+
+// overflowError returns the error for an integer or float
+// that doesn't fit in a value of type t.
+func overflowError(t reflect.Type) error {
+	return errors.New("cbor: number overflows Go value of type " + t.String())
+}
+
+// unmarshaler decodes the next data item into p using its UnmarshalBinary
+// method for byte strings or its UnmarshalText method for text strings.
+// It reports false if p has no such method for the next data item.
+func (d *decodeState) unmarshaler(p reflect.Value) (bool, error) {
+	major := d.data[d.off] & 0xe0
+	switch {
+	case major == cborTypeByteString && p.Type().Implements(typeBinaryUnmarshaler):
+	case major == cborTypeTextString && p.Type().Implements(typeTextUnmarshaler):
+	default:
+		return false, nil
+	}
+	_, info, arg, err := d.head()
+	if err != nil {
+		return true, err
+	}
+	s, err := d.str(major, info, arg)
+	if err != nil {
+		return true, err
+	}
+	if major == cborTypeByteString {
+		return true, p.Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary(append([]byte{}, s...))
+	}
+	if !utf8.Valid(s) {
+		return true, errInvalidUTF8
+	}
+	return true, p.Interface().(encoding.TextUnmarshaler).UnmarshalText(s)
+}
+
+// array decodes the elements of an array into the slice or array v.
+func (d *decodeState) array(v reflect.Value, info byte, arg uint64) error {
+	n, err := d.length(info, arg)
+	if err != nil {
+		return err
+	}
+	if v.Kind() == reflect.Slice {
+		v.Set(reflect.MakeSlice(v.Type(), n, n))
+	}
+	i := 0
+	for ; ; i++ {
+		ok, err := d.more(cborTypeArray, uint64(i), info, arg)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		if i >= v.Len() {
+			if v.Kind() == reflect.Array {
+				return errors.New("cbor: cannot unmarshal array longer than Go value of type " + v.Type().String())
+			}
+			v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+		}
+		if err := d.value(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	if i < v.Len() {
+		return errors.New("cbor: cannot unmarshal array shorter than Go value of type " + v.Type().String())
+	}
+	return nil
+}
+
+// mapValue decodes the entries of a map into the map v.
+func (d *decodeState) mapValue(v reflect.Value, info byte, arg uint64) error {
+	n, err := d.length(info, arg)
+	if err != nil {
+		return err
+	}
+	t := v.Type()
+	if v.IsNil() {
+		v.Set(reflect.MakeMapWithSize(t, n))
+	}
+	for i := uint64(0); ; i++ {
+		ok, err := d.more(cborTypeMap, i, info, arg)
+		if err != nil || !ok {
+			return err
+		}
+		k := reflect.New(t.Key()).Elem()
+		if err := d.value(k); err != nil {
+			return err
+		}
+		if !hashable(k) {
+			return errors.New("cbor: invalid map key type " + k.Elem().Type().String())
+		}
+		x := reflect.New(t.Elem()).Elem()
+		if err := d.value(x); err != nil {
+			return err
+		}
+		v.SetMapIndex(k, x)
+	}
+}
+
+// structArray decodes the elements of an array into
+// the fields of the struct v in order.
+func (d *decodeState) structArray(v reflect.Value, info byte, arg uint64) error {
+	fields := cachedFields(v.Type(), false)
+	if fields.err != nil {
+		return fields.err
+	}
+	i := 0
+	for ; ; i++ {
+		ok, err := d.more(cborTypeArray, uint64(i), info, arg)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		if i >= len(fields.list) {
+			return errors.New("cbor: cannot unmarshal array longer than the fields of Go struct " + v.Type().String())
+		}
+		if err := d.field(v, &fields.list[i]); err != nil {
+			return err
+		}
+	}
+	if i < len(fields.list) {
+		return errors.New("cbor: cannot unmarshal array shorter than the fields of Go struct " + v.Type().String())
+	}
+	return nil
+}
+
+// structMap decodes the entries of a map into the fields of the struct v
+// encoded with the same keys. Entries without a matching field are skipped.
+func (d *decodeState) structMap(v reflect.Value, info byte, arg uint64) error {
+	fields := cachedFields(v.Type(), false)
+	if fields.err != nil {
+		return fields.err
+	}
+	for i := uint64(0); ; i++ {
+		ok, err := d.more(cborTypeMap, i, info, arg)
+		if err != nil || !ok {
+			return err
+		}
+		key, err := d.any()
+		if err != nil {
+			return err
+		}
+		var f *field
+		for j := range fields.list {
+			g := &fields.list[j]
+			switch k := key.(type) {
+			case string:
+				ok = !g.keyAsInt && g.name == k
+			case uint64:
+				ok = g.keyAsInt && g.keyInt >= 0 && uint64(g.keyInt) == k
+			case int64:
+				ok = g.keyAsInt && g.keyInt == k
+			default:
+				ok = false
+			}
+			if ok {
+				f = g
+				break
+			}
+		}
+		if f == nil {
+			err = d.skip()
+		} else {
+			err = d.field(v, f)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// field decodes the next data item into the field f of the struct v,
+// allocating the embedded struct pointers on its path.
+func (d *decodeState) field(v reflect.Value, f *field) error {
+	for i, x := range f.index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !v.CanSet() {
+					return errors.New("cbor: cannot set embedded pointer to unexported struct " + v.Type().Elem().String())
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	if !f.char || d.off >= len(d.data) || d.data[d.off]&0xe0 != cborTypeTextString {
+		return d.value(v)
+	}
+	_, info, arg, err := d.head()
+	if err != nil {
+		return err
+	}
+	s, err := d.text(info, arg)
+	if err != nil {
+		return err
+	}
+	r, size := utf8.DecodeRuneInString(s)
+	if size == 0 || size != len(s) {
+		return errors.New("cbor: cannot unmarshal text string " + strconv.Quote(s) + " into rune field " + f.name)
+	}
+	v.SetInt(int64(r))
+	return nil
+}
+
+// bigInt decodes an integer or a bignum into the big.Int v.
+func (d *decodeState) bigInt(v reflect.Value) error {
+	major, _, arg, err := d.head()
+	if err != nil {
+		return err
+	}
+	var x *big.Int
+	switch {
+	case major == cborTypePositiveInt:
+		x = new(big.Int).SetUint64(arg)
+	case major == cborTypeNegativeInt:
+		x = negativeBigInt(new(big.Int).SetUint64(arg))
+	case major == cborTypeTag && (arg == 2 || arg == 3):
+		if x, err = d.bignum(arg); err != nil {
+			return err
+		}
+	default:
+		return unmarshalTypeError(major, v.Type())
+	}
+	v.Set(reflect.ValueOf(x).Elem())
+	return nil
+}
+
+// time decodes a standard date/time string (tag 0) or an epoch-based
+// date/time (tag 1) into the time.Time v. Epoch-based times are in UTC.
+func (d *decodeState) time(v reflect.Value) error {
+	major, _, num, err := d.head()
+	if err != nil {
+		return err
+	}
+	if major != cborTypeTag || (num != 0 && num != 1) {
+		return unmarshalTypeError(major, v.Type())
+	}
+	var t time.Time
+	if num == 0 {
+		var s string
+		if err := d.value(reflect.ValueOf(&s).Elem()); err != nil {
+			return err
+		}
+		if t, err = time.Parse(time.RFC3339Nano, s); err != nil {
+			return err
+		}
+	} else {
+		var secs interface{}
+		if secs, err = d.any(); err != nil {
+			return err
+		}
+		switch secs := secs.(type) {
+		case uint64:
+			if secs > math.MaxInt64 {
+				return overflowError(v.Type())
+			}
+			t = time.Unix(int64(secs), 0)
+		case int64:
+			t = time.Unix(secs, 0)
+		case float64:
+			if math.IsNaN(secs) || math.IsInf(secs, 0) {
+				return errors.New("cbor: invalid epoch-based date/time")
+			}
+			sec, frac := math.Modf(secs)
+			t = time.Unix(int64(sec), int64(frac*1e9))
+		default:
+			return errors.New("cbor: invalid epoch-based date/time")
+		}
+		t = t.UTC()
+	}
+	v.Set(reflect.ValueOf(t))
+	return nil
+}
@@ -0,0 +1,428 @@
+package cbor
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"math/big"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadHead(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      []byte
+		majorType byte
+		argument  uint64
+		headLen   int
+		err       error
+	}{
+		{"direct", hexDecode("17"), cborTypePositiveInt, 23, 1, nil},
+		{"one byte", hexDecode("3818ff"), cborTypeNegativeInt, 24, 2, nil},
+		{"two bytes", hexDecode("590102"), cborTypeByteString, 258, 3, nil},
+		{"four bytes", hexDecode("7a01020304"), cborTypeTextString, 0x01020304, 5, nil},
+		{"eight bytes", hexDecode("9b0102030405060708"), cborTypeArray, 0x0102030405060708, 9, nil},
+		{"tag", hexDecode("d9d9f7"), cborTypeTag, 55799, 3, nil},
+		{"simple", hexDecode("f5"), cborTypePrimitives, 21, 1, nil},
+		{"float16", hexDecode("f97e00"), cborTypePrimitives, 0x7e00, 3, nil},
+		{"indefinite", hexDecode("bf"), cborTypeMap, 0, 1, errIndefinite},
+		{"break", hexDecode("ff"), cborTypePrimitives, 0, 1, errIndefinite},
+		{"reserved 28", hexDecode("1c"), cborTypePositiveInt, 0, 0, errReservedInfo},
+		{"reserved 30", hexDecode("5e"), cborTypeByteString, 0, 0, errReservedInfo},
+		{"empty", nil, 0, 0, 0, errUnexpectedEnd},
+		{"truncated", hexDecode("1a0102"), cborTypePositiveInt, 0, 0, errUnexpectedEnd},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			majorType, argument, headLen, err := readHead(tt.data)
+			if err != tt.err {
+				t.Fatalf("readHead(0x%x) returned error %v, want %v", tt.data, err, tt.err)
+			}
+			if majorType != tt.majorType || argument != tt.argument || headLen != tt.headLen {
+				t.Errorf("readHead(0x%x) = (0x%x, %d, %d), want (0x%x, %d, %d)", tt.data, majorType, argument, headLen, tt.majorType, tt.argument, tt.headLen)
+			}
+		})
+	}
+}
+
+// containsInterface reports whether values of type t can hold interfaces,
+// which Unmarshal fills with its own choice of Go types.
+func containsInterface(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Interface:
+		return true
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		return containsInterface(t.Elem())
+	case reflect.Map:
+		return containsInterface(t.Key()) || containsInterface(t.Elem())
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if containsInterface(t.Field(i).Type) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestUnmarshalRoundTrip(t *testing.T) {
+	for _, tc := range marshalTests {
+		for _, value := range tc.values {
+			typ := reflect.TypeOf(value)
+			if typ == nil {
+				continue
+			}
+			p := reflect.New(typ)
+			if err := Unmarshal(tc.cborData, p.Interface()); err != nil {
+				t.Errorf("Unmarshal(0x%x) into %T returned error %v", tc.cborData, value, err)
+				continue
+			}
+			got := p.Elem().Interface()
+			if b, err := Marshal(got); err != nil {
+				t.Errorf("Marshal(%v) returned error %v", got, err)
+			} else if !bytes.Equal(b, tc.cborData) {
+				t.Errorf("Marshal(Unmarshal(0x%x)) = 0x%x", tc.cborData, b)
+			}
+			if f, ok := value.(float64); ok && math.IsNaN(f) {
+				continue
+			}
+			if !containsInterface(typ) && typ != typeBigInt && !reflect.DeepEqual(got, value) {
+				t.Errorf("Unmarshal(0x%x) = %#v, want %#v", tc.cborData, got, value)
+			}
+		}
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	type tagged struct {
+		A int    `cbor:"a"`
+		B string `cbor:"2,keyasint"`
+		C []byte `cbor:"c,omitempty"`
+		R rune   `cbor:"r,char"`
+	}
+	type Embedded struct {
+		E int `cbor:"e"`
+	}
+	type withEmbedded struct {
+		*Embedded
+		F int `cbor:"f"`
+	}
+	tests := []struct {
+		name string
+		data string
+		want interface{}
+	}{
+		{"interface uint", "1bffffffffffffffff", uint64(math.MaxUint64)},
+		{"interface int", "3903e7", int64(-1000)},
+		{"interface bignum", "3bffffffffffffffff", bigIntOrPanic("-18446744073709551616")},
+		{"interface tag bignum", "c249010000000000000000", bigIntOrPanic("18446744073709551616")},
+		{"interface float16", "f93e00", 1.5},
+		{"interface array", "8301f6f5", []interface{}{uint64(1), nil, true}},
+		{"interface map", "a2616101f5a0", map[interface{}]interface{}{"a": uint64(1), true: map[interface{}]interface{}{}}},
+		{"interface tag", "d82076687474703a2f2f7777772e6578616d706c652e636f6d", Tag{32, "http://www.example.com"}},
+		{"indefinite bytes", "5f42010243030405ff", []byte{1, 2, 3, 4, 5}},
+		{"indefinite text", "7f657374726561646d696e67ff", "streaming"},
+		{"indefinite array", "9f018202039f0405ffff", []interface{}{uint64(1), []interface{}{uint64(2), uint64(3)}, []interface{}{uint64(4), uint64(5)}}},
+		{"indefinite slice", "9f0102ff", []int{1, 2}},
+		{"indefinite map", "bf61610161629f0203ffff", map[string]interface{}{"a": uint64(1), "b": []interface{}{uint64(2), uint64(3)}}},
+		{"ignored tag", "d8200a", 10},
+		{"float32", "fa47c35000", float32(100000)},
+		{"float16 into float32", "f97c00", float32(math.Inf(1))},
+		{"pointer", "0a", func() *int { i := 10; return &i }()},
+		{"null pointer", "f6", (*int)(nil)},
+		{"undefined slice", "f7", []int(nil)},
+		{"big.Int", "3903e7", *big.NewInt(-1000)},
+		{"big.Int pointer", "c349010000000000000000", func() *big.Int { x := bigIntOrPanic("-18446744073709551617"); return &x }()},
+		{"time RFC 3339", "c074323031332d30332d32315432303a30343a30305a", time.Date(2013, 3, 21, 20, 4, 0, 0, time.UTC)},
+		{"time epoch", "c11a514b67b0", time.Date(2013, 3, 21, 20, 4, 0, 0, time.UTC)},
+		{"time epoch float", "c1fb41d452d9ec200000", time.Date(2013, 3, 21, 20, 4, 0, 5e8, time.UTC)},
+		{"text unmarshaler", "6b3139322e302e322e323335", net.ParseIP("192.0.2.235")},
+		{"raw bytes", "8201a0", RawBytes(hexDecode("8201a0"))},
+		{"raw tag", "c11a514b67b0", RawTag{1, hexDecode("1a514b67b0")}},
+		{"struct map", "a4616101026261626163416161726161", tagged{A: 1, B: "ab", C: []byte{0x61}, R: 'a'}},
+		{"struct embedded", "a2616501616602", withEmbedded{&Embedded{1}, 2}},
+		{"struct array", "83010203", func() interface{} {
+			return struct{ X, Y, Z int }{1, 2, 3}
+		}()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := reflect.New(reflect.TypeOf(tt.want))
+			if err := Unmarshal(hexDecode(tt.data), p.Interface()); err != nil {
+				t.Fatal(err)
+			}
+			if got := p.Elem().Interface(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnmarshalError(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		v    interface{}
+	}{
+		{"nil pointer", "00", (*int)(nil)},
+		{"not a pointer", "00", 0},
+		{"extraneous data", "0000", new(int)},
+		{"truncated", "1a0102", new(int)},
+		{"truncated array", "9affffffff", new([]int)},
+		{"overflow", "190100", new(uint8)},
+		{"negative into uint", "20", new(uint)},
+		{"int overflow", "1b8000000000000000", new(int64)},
+		{"float overflow", "fb7e37e43c8800759c", new(float32)},
+		{"type mismatch", "6161", new(int)},
+		{"array length", "820102", new([3]int)},
+		{"struct array length", "820102", new(struct{ X, Y, Z int })},
+		{"invalid utf-8", "62c328", new(string)},
+		{"invalid chunk", "5f6161ff", new([]byte)},
+		{"unexpected break", "ff", new(interface{})},
+		{"unhashable key", "a1800a", new(interface{})},
+		{"unhashable interface key", "a1800a", new(map[interface{}]int)},
+		{"simple value", "f0", new(interface{})},
+		{"non-empty interface", "00", new(error)},
+		{"char", "a1617262616263", new(struct {
+			R rune `cbor:"r,char"`
+		})},
+		{"time tag", "c21a514b67b0", new(time.Time)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Unmarshal(hexDecode(tt.data), tt.v); err == nil {
+				t.Errorf("Unmarshal(0x%s) into %T succeeded", tt.data, tt.v)
+			}
+		})
+	}
+}
+
+func TestUnmarshalRawMessage(t *testing.T) {
+	type envelope struct {
+		Kind string     `cbor:"kind"`
+		Body RawMessage `cbor:"body"`
+	}
+	type ping struct {
+		Seq int `cbor:"seq"`
+	}
+	// {"body": {"seq": 7}, "kind": "ping"}
+	data := hexDecode("a264626f6479a16373657107646b696e646470696e67")
+	var env envelope
+	if err := Unmarshal(data, &env); err != nil {
+		t.Fatal(err)
+	}
+	if env.Kind != "ping" || !bytes.Equal(env.Body, hexDecode("a16373657107")) {
+		t.Fatalf("Unmarshal() = %+v", env)
+	}
+	// The captured bytes are a copy.
+	data[11] = 0x08
+	var p ping
+	if err := Unmarshal(env.Body, &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Seq != 7 {
+		t.Errorf("Unmarshal(body) = %+v, want seq 7", p)
+	}
+	// Replaying the envelope reproduces the original encoding.
+	data[11] = 0x07
+	if got, err := Marshal(env); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got, data) {
+		t.Errorf("Marshal(%+v) = 0x%x, want 0x%x", env, got, data)
+	}
+
+	var m RawMessage
+	if err := Unmarshal(hexDecode("f6"), &m); err != nil || !bytes.Equal(m, hexDecode("f6")) {
+		t.Errorf("Unmarshal(null) = 0x%x, %v, want 0xf6", m, err)
+	}
+}
+
+// version is encoded as a "major.minor" text string.
+type version struct {
+	Major, Minor int
+}
+
+func (v version) MarshalCBORValue(b *Builder) error {
+	b.AddString(strconv.Itoa(v.Major) + "." + strconv.Itoa(v.Minor))
+	return nil
+}
+
+func (v *version) UnmarshalCBORValue(data []byte) error {
+	var s string
+	if err := Unmarshal(data, &s); err != nil {
+		return err
+	}
+	i := strings.IndexByte(s, '.')
+	if i < 0 {
+		return errors.New("invalid version " + s)
+	}
+	var err error
+	if v.Major, err = strconv.Atoi(s[:i]); err != nil {
+		return err
+	}
+	v.Minor, err = strconv.Atoi(s[i+1:])
+	return err
+}
+
+func TestUnmarshalingValue(t *testing.T) {
+	type release struct {
+		Name    string     `cbor:"name"`
+		Version version    `cbor:"version"`
+		Deps    []*version `cbor:"deps"`
+	}
+	want := release{"cbor", version{1, 2}, []*version{{0, 9}, nil}}
+	data, err := Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// {"deps": ["0.9", null], "name": "cbor", "version": "1.2"}
+	if wantData := hexDecode("a364646570738263302e39f6646e616d656463626f726776657273696f6e63312e32"); !bytes.Equal(data, wantData) {
+		t.Fatalf("Marshal(%+v) = 0x%x, want 0x%x", want, data, wantData)
+	}
+	var got release
+	if err := Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unmarshal() = %+v, want %+v", got, want)
+	}
+
+	var v version
+	if err := Unmarshal(hexDecode("62312e"), &v); err == nil {
+		t.Error("Unmarshal(\"1.\") succeeded")
+	}
+	if err := Unmarshal(hexDecode("f6"), &v); err == nil {
+		t.Error("Unmarshal(null) did not call UnmarshalCBORValue")
+	}
+}
+
+func TestFlags(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags Flags
+		want  string
+		// decoded is the result of decoding, without trailing false flags.
+		decoded Flags
+	}{
+		{"nil", nil, "00", Flags{}},
+		{"none", Flags{false, false}, "00", Flags{}},
+		{"bits", Flags{true, false, true, true, false}, "0d", Flags{true, false, true, true}},
+		{"two bytes", Flags{7: true, 9: false, 8: true}, "190180", Flags{7: true, 8: true}},
+		{"bit 63", Flags{63: true}, "1b8000000000000000", Flags{63: true}},
+		{"too many", Flags{64: true}, "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := Marshal(tt.flags)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("Marshal(%v) = 0x%x, want error", tt.flags, data)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, hexDecode(tt.want)) {
+				t.Errorf("Marshal(%v) = 0x%x, want 0x%s", tt.flags, data, tt.want)
+			}
+			var got Flags
+			if err := Unmarshal(data, &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.decoded) {
+				t.Errorf("Unmarshal(0x%x) = %v, want %v", data, got, tt.decoded)
+			}
+			for i := 0; i < 70; i++ {
+				if got.Has(i) != tt.flags.Has(i) {
+					t.Errorf("Has(%d) = %v after decoding, want %v", i, got.Has(i), tt.flags.Has(i))
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeOptionsLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		opts DecodeOptions
+		data string
+		want string
+	}{
+		{"huge array", DecodeOptions{}, "9affffffff00", "cbor: array exceeds MaxArrayElements (131072)"},
+		{"huge map", DecodeOptions{}, "bb0000000100000000", "cbor: map exceeds MaxMapPairs (131072)"},
+		{"huge byte string", DecodeOptions{}, "5b00000000ffffffff", "cbor: string exceeds MaxStringBytes (16777216)"},
+		{"huge text string", DecodeOptions{}, "7a01000001", "cbor: string exceeds MaxStringBytes (16777216)"},
+		{"array limit", DecodeOptions{MaxArrayElements: 2}, "83010203", "cbor: array exceeds MaxArrayElements (2)"},
+		{"nested array limit", DecodeOptions{MaxArrayElements: 2}, "8201830102f6", "cbor: array exceeds MaxArrayElements (2)"},
+		{"indefinite array limit", DecodeOptions{MaxArrayElements: 2}, "9f010203ff", "cbor: array exceeds MaxArrayElements (2)"},
+		{"map limit", DecodeOptions{MaxMapPairs: 1}, "a201020304", "cbor: map exceeds MaxMapPairs (1)"},
+		{"indefinite map limit", DecodeOptions{MaxMapPairs: 1}, "bf01020304ff", "cbor: map exceeds MaxMapPairs (1)"},
+		{"string limit", DecodeOptions{MaxStringBytes: 3}, "6449455446", "cbor: string exceeds MaxStringBytes (3)"},
+		{"chunked string limit", DecodeOptions{MaxStringBytes: 3}, "5f420102420304ff", "cbor: string exceeds MaxStringBytes (3)"},
+		{"within limits", DecodeOptions{MaxArrayElements: 3, MaxMapPairs: 1, MaxStringBytes: 4}, "83a161610164494554464449455446", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var v interface{}
+			if err := tt.opts.Unmarshal(hexDecode(tt.data), &v); (err == nil && tt.want != "") || (err != nil && err.Error() != tt.want) {
+				t.Errorf("Unmarshal() returned error %v, want %q", err, tt.want)
+			}
+			if err := tt.opts.NewDecoder(bytes.NewReader(hexDecode(tt.data))).Decode(&v); (err == nil && tt.want != "") || (err != nil && err.Error() != tt.want) {
+				t.Errorf("Decode() returned error %v, want %q", err, tt.want)
+			}
+		})
+	}
+
+	// Limits also apply to the items skipped for unknown struct fields.
+	var s struct{}
+	if err := (DecodeOptions{MaxArrayElements: 1}).Unmarshal(hexDecode("a1617882f5f5"), &s); err == nil {
+		t.Error("Unmarshal() skipped an array exceeding MaxArrayElements")
+	}
+	// Without a limit, the length is only bounded by the data.
+	var v interface{}
+	if err := (DecodeOptions{MaxArrayElements: -1}).Unmarshal(hexDecode("9a0100000000"), &v); err != errUnexpectedEnd {
+		t.Errorf("Unmarshal() returned error %v, want %v", err, errUnexpectedEnd)
+	}
+}
+
+// nested returns n times the head prefix followed by the data item last.
+func nested(prefix string, n int, last string) []byte {
+	return hexDecode(strings.Repeat(prefix, n) + last)
+}
+
+func TestDecodeOptionsMaxNestedLevels(t *testing.T) {
+	const defaultErr = "cbor: data item exceeds MaxNestedLevels (1024)"
+	tests := []struct {
+		name string
+		opts DecodeOptions
+		data []byte
+		v    interface{}
+		want string
+	}{
+		{"deep arrays", DecodeOptions{}, nested("81", 4000000, "00"), new(interface{}), defaultErr},
+		{"deep arrays typed", DecodeOptions{}, nested("81", 4000000, "00"), new([]interface{}), defaultErr},
+		{"deep maps", DecodeOptions{}, nested("a100", 4000000, "00"), new(interface{}), defaultErr},
+		{"deep tags", DecodeOptions{}, nested("c6", 4000000, "00"), new(interface{}), defaultErr},
+		{"deep ignored tags", DecodeOptions{}, nested("c6", 4000000, "00"), new(int), defaultErr},
+		{"deep skipped field", DecodeOptions{}, append(hexDecode("a16178"), nested("81", 4000000, "00")...), new(struct{}), defaultErr},
+		{"deep raw message", DecodeOptions{}, nested("9f", 4000000, "00"), new(RawMessage), defaultErr},
+		{"at default limit", DecodeOptions{}, nested("81", 1024, "00"), new(interface{}), ""},
+		{"at limit", DecodeOptions{MaxNestedLevels: 2}, hexDecode("818100"), new(interface{}), ""},
+		{"over limit", DecodeOptions{MaxNestedLevels: 2}, hexDecode("81818100"), new(interface{}), "cbor: data item exceeds MaxNestedLevels (2)"},
+		{"tag over limit", DecodeOptions{MaxNestedLevels: 2}, hexDecode("81c18100"), new(interface{}), "cbor: data item exceeds MaxNestedLevels (2)"},
+		{"no limit", DecodeOptions{MaxNestedLevels: -1}, nested("81", 10000, "00"), new(interface{}), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.opts.Unmarshal(tt.data, tt.v); (err == nil && tt.want != "") || (err != nil && err.Error() != tt.want) {
+				t.Errorf("Unmarshal() returned error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,249 @@
+package cbor
+
+import (
+	"encoding/hex"
+	"errors"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+
+	"github.com/x448/float16"
+)
+
+var errExtraneousData = errors.New("cbor: extraneous data")
+
+// diagLimits bounds the recursion of diagnose.
+var diagLimits = decodeLimits{maxNestedLevels: DefaultMaxNestedLevels}
+
+// Diagnose returns the extended diagnostic notation of the CBOR data item
+// in data, as described in RFC 8949 section 8, for example
+// [1, h'0102', {"a": true}, 1(1363896240)].
+// Indefinite-length items are written with a leading underscore, such as
+// [_ 1, 2] or (_ "strea", "ming").
+// Items nested more than DefaultMaxNestedLevels deep are reported as an error.
+func Diagnose(data []byte) (string, error) {
+	var sb strings.Builder
+	n, err := diagnose(&sb, data, 0)
+	if err != nil {
+		return "", err
+	}
+	if n != len(data) {
+		return "", errExtraneousData
+	}
+	return sb.String(), nil
+}
+
+// diagnose writes the diagnostic notation of the data item at the start
+// of data to sb and returns its encoded length. depth is the number of
+// arrays, maps and tags enclosing the data item.
+func diagnose(sb *strings.Builder, data []byte, depth int) (int, error) {
+	major, arg, n, err := readHead(data)
+	indefinite := err == errIndefinite
+	if err != nil && !indefinite {
+		return 0, err
+	}
+	if major == cborTypeArray || major == cborTypeMap || major == cborTypeTag {
+		depth++
+		if err := diagLimits.nest(depth); err != nil {
+			return 0, err
+		}
+	}
+	if indefinite {
+		switch major {
+		case cborTypeByteString, cborTypeTextString:
+			return diagnoseChunks(sb, data, major, depth)
+		case cborTypeArray, cborTypeMap:
+		default:
+			return 0, errInvalidIndefinite
+		}
+	}
+	switch major {
+	case cborTypePositiveInt:
+		sb.WriteString(strconv.FormatUint(arg, 10))
+	case cborTypeNegativeInt:
+		if arg == math.MaxUint64 {
+			sb.WriteString(new(big.Int).Neg(new(big.Int).Add(new(big.Int).SetUint64(arg), big.NewInt(1))).String())
+		} else {
+			sb.WriteString("-" + strconv.FormatUint(arg+1, 10))
+		}
+	case cborTypeByteString, cborTypeTextString:
+		if arg > uint64(len(data)-n) {
+			return 0, errUnexpectedEnd
+		}
+		content := data[n : n+int(arg)]
+		if major == cborTypeByteString {
+			sb.WriteString("h'" + hex.EncodeToString(content) + "'")
+		} else {
+			writeText(sb, string(content))
+		}
+		n += int(arg)
+	case cborTypeArray, cborTypeMap:
+		open, close := "[", "]"
+		if major == cborTypeMap {
+			open, close = "{", "}"
+		}
+		sb.WriteString(open)
+		if indefinite {
+			sb.WriteString("_ ")
+		}
+		for i := uint64(0); indefinite || i < arg; i++ {
+			if indefinite {
+				if n >= len(data) {
+					return 0, errUnexpectedEnd
+				}
+				if data[n] == cborBreak {
+					n++
+					break
+				}
+			}
+			if i > 0 {
+				sb.WriteString(", ")
+			}
+			m, err := diagnose(sb, data[n:], depth)
+			if err != nil {
+				return 0, err
+			}
+			n += m
+			if major == cborTypeMap {
+				sb.WriteString(": ")
+				m, err := diagnose(sb, data[n:], depth)
+				if err != nil {
+					return 0, err
+				}
+				n += m
+			}
+		}
+		sb.WriteString(close)
+	case cborTypeTag:
+		sb.WriteString(strconv.FormatUint(arg, 10) + "(")
+		m, err := diagnose(sb, data[n:], depth)
+		if err != nil {
+			return 0, err
+		}
+		n += m
+		sb.WriteString(")")
+	case cborTypePrimitives:
+		switch info := data[0] & 0x1f; {
+		case info == 25:
+			sb.WriteString(formatFloat(float64(float16.Frombits(uint16(arg)).Float32())))
+		case info == 26:
+			sb.WriteString(formatFloat(float64(math.Float32frombits(uint32(arg)))))
+		case info == 27:
+			sb.WriteString(formatFloat(math.Float64frombits(arg)))
+		case arg == 20:
+			sb.WriteString("false")
+		case arg == 21:
+			sb.WriteString("true")
+		case arg == 22:
+			sb.WriteString("null")
+		case arg == 23:
+			sb.WriteString("undefined")
+		case info == 24 && arg < 32:
+			return 0, errInvalidSimple
+		default:
+			sb.WriteString("simple(" + strconv.FormatUint(arg, 10) + ")")
+		}
+	}
+	return n, nil
+}
+
+// diagnoseChunks writes the chunks of the indefinite-length string
+// at the start of data, whose major type is major.
+func diagnoseChunks(sb *strings.Builder, data []byte, major byte, depth int) (int, error) {
+	sb.WriteString("(_ ")
+	n := 1
+	for i := 0; ; i++ {
+		if n >= len(data) {
+			return 0, errUnexpectedEnd
+		}
+		if data[n] == cborBreak {
+			n++
+			break
+		}
+		if data[n]&0xe0 != major || data[n]&0x1f == 31 {
+			return 0, errInvalidChunk
+		}
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		m, err := diagnose(sb, data[n:], depth)
+		if err != nil {
+			return 0, err
+		}
+		n += m
+	}
+	sb.WriteString(")")
+	return n, nil
+}
+
+// writeText writes s to sb as a JSON string, as RFC 8949 section 8
+// requires. Non-printable characters are escaped as \uXXXX, with
+// a surrogate pair for those beyond the Basic Multilingual Plane.
+func writeText(sb *strings.Builder, s string) {
+	const hexDigits = "0123456789abcdef"
+	escape := func(r rune) {
+		sb.WriteString(`\u`)
+		for shift := 12; shift >= 0; shift -= 4 {
+			sb.WriteByte(hexDigits[r>>shift&0xf])
+		}
+	}
+	sb.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"', '\\':
+			sb.WriteByte('\\')
+			sb.WriteRune(r)
+		case '\b':
+			sb.WriteString(`\b`)
+		case '\f':
+			sb.WriteString(`\f`)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\r':
+			sb.WriteString(`\r`)
+		case '\t':
+			sb.WriteString(`\t`)
+		default:
+			switch {
+			case unicode.IsPrint(r):
+				sb.WriteRune(r)
+			case r > 0xffff:
+				r1, r2 := utf16.EncodeRune(r)
+				escape(r1)
+				escape(r2)
+			default:
+				escape(r)
+			}
+		}
+	}
+	sb.WriteByte('"')
+}
+
+// formatFloat formats f as in the examples of RFC 8949 appendix A,
+// which always include a fraction or an exponent.
+func formatFloat(f float64) string {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	}
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	mant, exp := s, ""
+	if i := strings.IndexByte(s, 'e'); i >= 0 {
+		mant, exp = s[:i], s[i:]
+		// Go writes at least two exponent digits.
+		if len(exp) == 4 && exp[2] == '0' {
+			exp = exp[:2] + exp[3:]
+		}
+	}
+	if !strings.Contains(mant, ".") {
+		mant += ".0"
+	}
+	return mant + exp
+}
@@ -0,0 +1,108 @@
+package cbor
+
+import "testing"
+
+func TestDiagnose(t *testing.T) {
+	// Vectors from RFC 8949 appendix A.
+	tests := []struct {
+		data string
+		want string
+	}{
+		{"00", "0"},
+		{"1b000000e8d4a51000", "1000000000000"},
+		{"1bffffffffffffffff", "18446744073709551615"},
+		{"c249010000000000000000", "2(h'010000000000000000')"},
+		{"3bffffffffffffffff", "-18446744073709551616"},
+		{"3903e7", "-1000"},
+		{"f90000", "0.0"},
+		{"f98000", "-0.0"},
+		{"f93c00", "1.0"},
+		{"fb3ff199999999999a", "1.1"},
+		{"f93e00", "1.5"},
+		{"f97bff", "65504.0"},
+		{"fa47c35000", "100000.0"},
+		{"fa7f7fffff", "3.4028234663852886e+38"},
+		{"fb7e37e43c8800759c", "1.0e+300"},
+		{"f90001", "5.960464477539063e-8"},
+		{"f9c400", "-4.0"},
+		{"f97c00", "Infinity"},
+		{"f97e00", "NaN"},
+		{"f9fc00", "-Infinity"},
+		{"fa7fc00000", "NaN"},
+		{"fb7ff0000000000000", "Infinity"},
+		{"f4", "false"},
+		{"f5", "true"},
+		{"f6", "null"},
+		{"f7", "undefined"},
+		{"f0", "simple(16)"},
+		{"f8ff", "simple(255)"},
+		{"c074323031332d30332d32315432303a30343a30305a", `0("2013-03-21T20:04:00Z")`},
+		{"c11a514b67b0", "1(1363896240)"},
+		{"d82076687474703a2f2f7777772e6578616d706c652e636f6d", `32("http://www.example.com")`},
+		{"40", "h''"},
+		{"4401020304", "h'01020304'"},
+		{"60", `""`},
+		{"62225c", `"\"\\"`},
+		{"62c3bc", `"ü"`},
+		{"6700070a0d09080c", `"\u0000\u0007\n\r\t\b\f"`},
+		{"64f09f9880", `"😀"`},
+		{"63e2808b", `"\u200b"`},
+		{"64f3a08081", `"\udb40\udc01"`},
+		{"80", "[]"},
+		{"83010203", "[1, 2, 3]"},
+		{"8301820203820405", "[1, [2, 3], [4, 5]]"},
+		{"a0", "{}"},
+		{"a201020304", "{1: 2, 3: 4}"},
+		{"a26161016162820203", `{"a": 1, "b": [2, 3]}`},
+		{"5f42010243030405ff", "(_ h'0102', h'030405')"},
+		{"7f657374726561646d696e67ff", `(_ "strea", "ming")`},
+		{"9fff", "[_ ]"},
+		{"9f018202039f0405ffff", "[_ 1, [2, 3], [_ 4, 5]]"},
+		{"bf61610161629f0203ffff", `{_ "a": 1, "b": [_ 2, 3]}`},
+	}
+	for _, tt := range tests {
+		got, err := Diagnose(hexDecode(tt.data))
+		if err != nil {
+			t.Errorf("Diagnose(0x%s) returned error %v", tt.data, err)
+		} else if got != tt.want {
+			t.Errorf("Diagnose(0x%s) = %s, want %s", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestDiagnoseInvalid(t *testing.T) {
+	for _, data := range []string{
+		"",
+		"1c",
+		"1a0102",
+		"62c3",
+		"8201",
+		"9f01",
+		"ff",
+		"1f",
+		"5f6161ff",
+		"0101",
+		"f818",
+		"f81f",
+	} {
+		if got, err := Diagnose(hexDecode(data)); err == nil {
+			t.Errorf("Diagnose(0x%s) = %s, want error", data, got)
+		}
+	}
+}
+
+func TestDiagnoseMaxNestedLevels(t *testing.T) {
+	const want = "cbor: data item exceeds MaxNestedLevels (1024)"
+	for _, data := range [][]byte{
+		nested("81", 4000000, "00"),
+		nested("a100", 1025, "00"),
+		nested("c1", 1025, "00"),
+	} {
+		if _, err := Diagnose(data); err == nil || err.Error() != want {
+			t.Errorf("Diagnose() returned error %v, want %s", err, want)
+		}
+	}
+	if _, err := Diagnose(nested("81", 1024, "00")); err != nil {
+		t.Errorf("Diagnose() returned error %v", err)
+	}
+}
@@ -0,0 +1,317 @@
+package cbor
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// field represents a single encodable struct field.
+type field struct {
+	name      string
+	index     []int
+	omitEmpty bool
+	omitZero  bool
+	keyAsInt  bool
+	keyInt    int64
+	// char reports whether the rune field is encoded as a text string.
+	char bool
+	// tagged reports whether the field name comes from a struct tag.
+	tagged bool
+}
+
+// sameKey reports whether f and g are encoded with the same map key.
+func (f *field) sameKey(g *field) bool {
+	if f.keyAsInt != g.keyAsInt {
+		return false
+	}
+	if f.keyAsInt {
+		return f.keyInt == g.keyInt
+	}
+	return f.name == g.name
+}
+
+// structFields holds the encodable fields of a struct type.
+type structFields struct {
+	list []field
+	// tagged reports whether any field has a cbor struct tag,
+	// in which case the struct is encoded as a map.
+	tagged bool
+	// toArray reports whether the struct has a blank field tagged
+	// with the toarray option, in which case the struct is always
+	// encoded as an array.
+	toArray bool
+	// err is set if a struct tag is invalid.
+	err error
+}
+
+type fieldCacheKey struct {
+	t           reflect.Type
+	useJSONTags bool
+}
+
+var fieldCache sync.Map // map[fieldCacheKey]structFields
+
+// cachedFields is like typeFields but uses a cache to avoid repeated work.
+func cachedFields(t reflect.Type, useJSONTags bool) structFields {
+	key := fieldCacheKey{t, useJSONTags}
+	if f, ok := fieldCache.Load(key); ok {
+		return f.(structFields)
+	}
+	f, _ := fieldCache.LoadOrStore(key, typeFields(t, useJSONTags))
+	return f.(structFields)
+}
+
+// typeFields returns the fields that should be encoded for the given struct type.
+// If useJSONTags is true, the json struct tag is used for fields without a cbor tag.
+//
+// The fields of anonymous embedded structs without a name tag are promoted
+// to the parent struct following the Go visibility rules, as in encoding/json:
+// among fields encoded with the same key, the shallowest one wins, and
+// if there are several at the same depth the tagged one wins.
+// If there is still more than one candidate, all of them are dropped.
+func typeFields(t reflect.Type, useJSONTags bool) structFields {
+	var fields structFields
+	type embedded struct {
+		typ   reflect.Type
+		index []int
+	}
+	type candidate struct {
+		field
+		depth int
+	}
+	var all []candidate
+	next := []embedded{{typ: t}}
+	visited := make(map[reflect.Type]bool)
+	for depth := 0; len(next) > 0; depth++ {
+		current := next
+		next = nil
+		// Types embedded more than once at the same depth
+		// are all visited so their fields annihilate each other.
+		for _, e := range current {
+			if visited[e.typ] {
+				continue
+			}
+			for i := 0; i < e.typ.NumField(); i++ {
+				sf := e.typ.Field(i)
+				if depth == 0 && sf.Name == "_" {
+					if _, opts := parseTag(sf.Tag.Get("cbor")); opts.Contains("toarray") {
+						fields.toArray = true
+					}
+				}
+				ft := sf.Type
+				if ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+				if sf.Anonymous {
+					// Unexported embedded structs can still promote exported fields.
+					if sf.PkgPath != "" && ft.Kind() != reflect.Struct {
+						continue
+					}
+				} else if sf.PkgPath != "" {
+					// Unexported fields, including blank "_" padding fields,
+					// are not part of the encoding.
+					continue
+				}
+				tag, ok := sf.Tag.Lookup("cbor")
+				fromJSON := false
+				if !ok && useJSONTags {
+					tag, ok = sf.Tag.Lookup("json")
+					fromJSON = ok
+				}
+				if tag == "-" {
+					// A field tagged "-" is never encoded. Use "-," to
+					// encode a field named "-".
+					continue
+				}
+				name, opts := parseTag(tag)
+				index := make([]int, len(e.index)+1)
+				copy(index, e.index)
+				index[len(e.index)] = i
+				if name == "" && sf.Anonymous && ft.Kind() == reflect.Struct {
+					next = append(next, embedded{ft, index})
+					continue
+				}
+				if sf.PkgPath != "" {
+					// Named unexported embedded structs are not encoded.
+					continue
+				}
+				if ok {
+					fields.tagged = true
+				}
+				// The integer key is either the field name, or the value of
+				// the option written as keyasint=N, which keeps the name.
+				key, keyOpt := opts.Value("keyasint")
+				if !keyOpt {
+					key = name
+				}
+				f := field{
+					name:      name,
+					index:     index,
+					omitEmpty: opts.Contains("omitempty"),
+					omitZero:  opts.Contains("omitzero"),
+					// json tags only share the omitempty option with cbor tags.
+					keyAsInt: !fromJSON && (keyOpt || opts.Contains("keyasint")),
+					tagged:   name != "",
+				}
+				if name == "" {
+					f.name = sf.Name
+				}
+				if !fromJSON && opts.Contains("char") {
+					f.char = true
+					if sf.Type.Kind() != reflect.Int32 && fields.err == nil {
+						fields.err = errors.New("cbor: char option requires a rune field, got " + sf.Type.String() + " for field " + e.typ.String() + "." + sf.Name)
+					}
+				}
+				if f.keyAsInt {
+					n, err := strconv.ParseInt(key, 10, 64)
+					if err != nil && fields.err == nil {
+						fields.err = errors.New("cbor: invalid keyasint name " + strconv.Quote(key) + " for field " + e.typ.String() + "." + sf.Name)
+					}
+					f.keyInt = n
+				}
+				all = append(all, candidate{f, depth})
+			}
+		}
+		for _, e := range current {
+			visited[e.typ] = true
+		}
+	}
+	for i := range all {
+		f := &all[i]
+		dominant := true
+		for j := range all {
+			g := &all[j]
+			if i == j || !f.sameKey(&g.field) {
+				continue
+			}
+			if g.depth < f.depth || (g.depth == f.depth && (g.tagged || !f.tagged)) {
+				dominant = false
+				break
+			}
+		}
+		if dominant {
+			fields.list = append(fields.list, f.field)
+		}
+	}
+	sort.Slice(fields.list, func(i, j int) bool {
+		x, y := fields.list[i].index, fields.list[j].index
+		for k := 0; k < len(x) && k < len(y); k++ {
+			if x[k] != y[k] {
+				return x[k] < y[k]
+			}
+		}
+		return len(x) < len(y)
+	})
+	if fields.toArray {
+		// Field keys are not used when encoding as an array.
+		fields.err = nil
+	}
+	return fields
+}
+
+// fieldByIndex is like reflect.Value.FieldByIndex but reports false
+// instead of panicking when traversing a nil embedded struct pointer.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// tagOptions is the string following a comma in a struct field's "cbor"
+// tag, or the empty string. It does not include the leading comma.
+type tagOptions string
+
+// parseTag splits a struct field's cbor tag into its name and
+// comma-separated options.
+func parseTag(tag string) (string, tagOptions) {
+	if idx := strings.Index(tag, ","); idx != -1 {
+		return tag[:idx], tagOptions(tag[idx+1:])
+	}
+	return tag, tagOptions("")
+}
+
+// Contains reports whether a comma-separated list of options
+// contains a particular option.
+func (o tagOptions) Contains(option string) bool {
+	s := string(o)
+	for s != "" {
+		var next string
+		i := strings.Index(s, ",")
+		if i >= 0 {
+			s, next = s[:i], s[i+1:]
+		}
+		if s == option {
+			return true
+		}
+		s = next
+	}
+	return false
+}
+
+// Value returns the value of an option written as option=value
+// in a comma-separated list of options.
+func (o tagOptions) Value(option string) (string, bool) {
+	s := string(o)
+	for s != "" {
+		var next string
+		i := strings.Index(s, ",")
+		if i >= 0 {
+			s, next = s[:i], s[i+1:]
+		}
+		if strings.HasPrefix(s, option+"=") {
+			return s[len(option)+1:], true
+		}
+		s = next
+	}
+	return "", false
+}
+
+// isZeroer is implemented by types such as time.Time
+// that define their own zero value.
+type isZeroer interface {
+	IsZero() bool
+}
+
+var typeIsZeroer = reflect.TypeOf((*isZeroer)(nil)).Elem()
+
+// isZeroValue reports whether v is the zero value
+// for the purposes of the omitzero option.
+// Pointers are only zero when nil, even if they point to a zero value.
+func isZeroValue(v reflect.Value) bool {
+	if z, ok := asInterface(v, typeIsZeroer); ok {
+		return z.(isZeroer).IsZero()
+	}
+	return v.IsZero()
+}
+
+// isEmptyValue reports whether v is the zero value
+// for the purposes of the omitempty option.
+// Pointers are only empty when nil, even if they point to an empty value.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
@@ -0,0 +1,131 @@
+package cbor
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// AddJSON parses the JSON value in data and appends the equivalent CBOR
+// data item. Numbers written without a fraction or an exponent are encoded
+// as integers, or bignums if they don't fit in 64 bits, other numbers as
+// floats. Objects are encoded as maps with their members sorted according
+// to ModeSort, or in document order with ModeSortNone.
+// If data is not a single valid JSON value, the error is returned and
+// set on the Builder.
+func (b *Builder) AddJSON(data []byte) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	v, err := readJSON(d)
+	if err == nil {
+		if _, err = d.Token(); err == io.EOF {
+			err = nil
+		} else {
+			err = errors.New("cbor: invalid JSON: trailing data")
+		}
+	}
+	if err != nil {
+		b.SetError(err)
+		return err
+	}
+	b.addJSON(v)
+	return b.err
+}
+
+// jsonObject holds the members of a JSON object in document order.
+type jsonObject []KeyValue
+
+// readJSON reads the next JSON value from d. Objects are read as
+// jsonObject, arrays as []interface{} and numbers as json.Number.
+func readJSON(d *json.Decoder) (interface{}, error) {
+	tok, err := d.Token()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('['):
+		arr := []interface{}{}
+		for d.More() {
+			v, err := readJSON(d)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		_, err := d.Token()
+		return arr, err
+	case json.Delim('{'):
+		obj := jsonObject{}
+		for d.More() {
+			k, err := d.Token()
+			if err != nil {
+				return nil, err
+			}
+			v, err := readJSON(d)
+			if err != nil {
+				return nil, err
+			}
+			obj = append(obj, KeyValue{k, v})
+		}
+		_, err := d.Token()
+		return obj, err
+	}
+	return tok, nil
+}
+
+func (b *Builder) addJSON(v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		b.AddNil()
+	case bool:
+		b.AddBool(v)
+	case string:
+		b.AddString(v)
+	case json.Number:
+		s := string(v)
+		if strings.ContainsAny(s, ".eE") {
+			f, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				b.SetError(err)
+				return
+			}
+			b.AddFloat64(f)
+		} else if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			b.AddInt64(n)
+		} else {
+			bi, _ := new(big.Int).SetString(s, 10)
+			b.AddBigInt(bi)
+		}
+	case []interface{}:
+		if !b.enter() {
+			return
+		}
+		defer b.leave()
+		b.AddArray(uint64(len(v)), func(b *Builder) {
+			for _, x := range v {
+				b.addJSON(x)
+			}
+		})
+	case jsonObject:
+		if !b.enter() {
+			return
+		}
+		defer b.leave()
+		b.AddMap(len(v))
+		for _, kv := range v {
+			kv := kv
+			b.AddMapItem(func(b *Builder) {
+				b.AddString(kv.Key.(string))
+			}, func(b *Builder) {
+				b.addJSON(kv.Value)
+			})
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package cbor
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestAddJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		b       Builder
+		json    string
+		want    []byte
+		wantErr bool
+	}{
+		// {"a": 1, "b": [true, null]}
+		{"object", Builder{}, `{"a":1,"b":[true,null]}`, hexDecode("a2616101616282f5f6"), false},
+		{"sorted", Builder{}, `{"bb":1,"a":2}`, hexDecode("a261610262626201"), false},
+		{"document order", Builder{ModeSort: ModeSortNone}, `{"bb":1,"a":2}`, hexDecode("a262626201616102"), false},
+		{"integers", Builder{}, `[0,-1,4294967296]`, hexDecode("8300201b0000000100000000"), false},
+		{"bignum", Builder{}, `18446744073709551616`, hexDecode("c249010000000000000000"), false},
+		{"floats", Builder{}, `[1.5,1e2,-0.0]`, hexDecode("83f93e00f95640f98000"), false},
+		{"string", Builder{}, ` "aü" `, hexDecode("6361c3bc"), false},
+		{"empty", Builder{}, `[{},[]]`, hexDecode("82a080"), false},
+		{"invalid", Builder{}, `{"a":}`, nil, true},
+		{"truncated", Builder{}, `[1`, nil, true},
+		{"trailing data", Builder{}, `1 2`, nil, true},
+		{"no value", Builder{}, ``, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.b
+			err := b.AddJSON([]byte(tt.json))
+			got, bErr := b.Bytes()
+			if err != bErr {
+				t.Errorf("AddJSON() returned error %v, Bytes() returned %v", err, bErr)
+			}
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("AddJSON(%s) = 0x%x, want error", tt.json, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("AddJSON(%s) returned error %v", tt.json, err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Errorf("AddJSON(%s) = 0x%x, want 0x%x", tt.json, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddJSONMaxNestingDepth(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		wantErr bool
+	}{
+		{"deep", strings.Repeat("[", 10) + strings.Repeat("]", 10), false},
+		{"too deep array", strings.Repeat("[", 11) + strings.Repeat("]", 11), true},
+		{"too deep object", strings.Repeat(`{"a":`, 11) + "1" + strings.Repeat("}", 11), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := Builder{MaxNestingDepth: 10}
+			err := b.AddJSON([]byte(tt.json))
+			if tt.wantErr {
+				if err == nil || err.Error() != "cbor: exceeded max nesting depth" {
+					t.Errorf("AddJSON() returned error %v, want max nesting depth error", err)
+				}
+			} else if err != nil {
+				t.Errorf("AddJSON() returned error %v", err)
+			}
+		})
+	}
+}
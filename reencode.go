@@ -0,0 +1,162 @@
+package cbor
+
+import (
+	"math"
+
+	"github.com/x448/float16"
+)
+
+// AddReencoded appends the data item in data re-encoded with the modes of
+// the Builder, which canonicalizes it: maps are sorted according to
+// ModeSort, floats take the shortest form allowed by ModeFloat,
+// indefinite-length items become definite-length ones and every head uses
+// its shortest form. Tags listed in StripTags are dropped and their
+// content is kept. Malformed data, data holding more than one data item
+// and data nested more than DefaultMaxNestedLevels deep set an error.
+func (b *Builder) AddReencoded(data []byte) {
+	if b.err != nil {
+		return
+	}
+	d := decodeState{data: data, decodeLimits: decodeLimits{maxNestedLevels: DefaultMaxNestedLevels}}
+	if err := b.reencode(&d); err != nil {
+		b.SetError(err)
+		return
+	}
+	if b.err == nil && d.off != len(data) {
+		b.SetError(errExtraneousData)
+	}
+}
+
+// reencode appends the next data item of d.
+func (b *Builder) reencode(d *decodeState) error {
+	if !b.enter() {
+		return b.err
+	}
+	defer b.leave()
+	for {
+		major, info, arg, err := d.head()
+		if err != nil {
+			return err
+		}
+		if major == cborTypeArray || major == cborTypeMap || major == cborTypeTag {
+			if err := d.enter(); err != nil {
+				return err
+			}
+			defer d.leave()
+		}
+		switch major {
+		case cborTypePositiveInt:
+			b.AddUint64(arg)
+		case cborTypeNegativeInt:
+			b.addUint64(cborTypeNegativeInt, arg)
+		case cborTypeByteString:
+			s, err := d.str(major, info, arg)
+			if err != nil {
+				return err
+			}
+			b.AddBytes(s)
+		case cborTypeTextString:
+			s, err := d.text(info, arg)
+			if err != nil {
+				return err
+			}
+			b.AddString(s)
+		case cborTypeArray:
+			n, err := d.count(major, info, arg)
+			if err != nil {
+				return err
+			}
+			b.AddArray(n, func(b *Builder) {
+				for i := uint64(0); err == nil && i < n; i++ {
+					err = b.reencode(d)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			if info == 31 {
+				// Skip the break.
+				d.off++
+			}
+		case cborTypeMap:
+			n, err := d.count(major, info, arg)
+			if err != nil {
+				return err
+			}
+			b.AddMap(int(n))
+			for i := uint64(0); err == nil && i < n; i++ {
+				b.AddMapItem(func(b *Builder) {
+					err = b.reencode(d)
+				}, func(b *Builder) {
+					if err == nil {
+						err = b.reencode(d)
+					}
+				})
+			}
+			if err != nil {
+				return err
+			}
+			if info == 31 {
+				d.off++
+			}
+		case cborTypeTag:
+			if !b.StripTags[arg] {
+				b.AddTag(arg)
+			}
+			// Go on with the tag content.
+			continue
+		default:
+			switch {
+			case info == 25:
+				// Modes other than ModeFloatNone are applied by AddFloat32,
+				// which gives back a float16 if ModeFloat allows it.
+				f := float16.Frombits(uint16(arg))
+				if v := f.Float32(); b.ModeFloat != ModeFloatNone || math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+					b.AddFloat32(v)
+				} else {
+					b.AddFloat16(f)
+				}
+			case info == 26:
+				b.AddFloat32(math.Float32frombits(uint32(arg)))
+			case info == 27:
+				b.AddFloat64(math.Float64frombits(arg))
+			case arg == 20 || arg == 21:
+				b.AddBool(arg == 21)
+			case arg == 22:
+				b.AddNil()
+			case arg == 23:
+				b.AddUndefined()
+			default:
+				b.AddSimpleValue(uint8(arg))
+			}
+		}
+		return nil
+	}
+}
+
+// count returns the number of elements of the array or map with the given
+// head. Indefinite-length items are counted by skipping their elements in
+// a copy of d, up to the break.
+func (d *decodeState) count(major, info byte, arg uint64) (uint64, error) {
+	if info != 31 {
+		if _, err := d.length(info, arg); err != nil {
+			return 0, err
+		}
+		return arg, nil
+	}
+	c := *d
+	for n := uint64(0); ; n++ {
+		ok, err := c.more(major, n, info, arg)
+		if err != nil || !ok {
+			return n, err
+		}
+		if err := c.skip(); err != nil {
+			return 0, err
+		}
+		if major == cborTypeMap {
+			if err := c.skip(); err != nil {
+				return 0, err
+			}
+		}
+	}
+}
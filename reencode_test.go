@@ -0,0 +1,142 @@
+package cbor
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAddReencoded(t *testing.T) {
+	strip := map[uint64]bool{55799: true, 1000: true}
+	tests := []struct {
+		name string
+		b    Builder
+		data string
+		want string
+	}{
+		// 55799(1000({"b": [1, 1(1363896240)], "a": 1.0}))
+		{"strip version tag", Builder{StripTags: strip}, "d9d9f7d903e8a261628201c11a514b67b06161f93c00", "a26161f93c0061628201c11a514b67b0"},
+		{"keep tags", Builder{}, "d9d9f7d903e8a261628201c11a514b67b06161f93c00", "d9d9f7d903e8a26161f93c0061628201c11a514b67b0"},
+		{"strip nested tag", Builder{StripTags: map[uint64]bool{1: true}}, "82c105c24101", "8205c24101"},
+		// [_ 0, 1.5, {_ "b": 1, "a": 2}, (_ h'01', h'02')]
+		{"canonicalize", Builder{}, "9f1800fb3ff8000000000000bf616201616102ff5f41014102ffff", "8400f93e00a2616102616201420102"},
+		{"sort none", Builder{ModeSort: ModeSortNone}, "a2616201616102", "a2616201616102"},
+		{"negative and simple values", Builder{}, "8439ffff20f7f0", "8439ffff20f7f0"},
+		{"float32 mode", Builder{ModeFloat: ModeFloat32}, "f93e00", "fa3fc00000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.b
+			b.AddReencoded(hexDecode(tt.data))
+			if got, err := b.Bytes(); err != nil {
+				t.Errorf("AddReencoded(0x%s) returned error %v", tt.data, err)
+			} else if !bytes.Equal(got, hexDecode(tt.want)) {
+				t.Errorf("AddReencoded(0x%s) = 0x%x, want 0x%s", tt.data, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddReencodedNested(t *testing.T) {
+	b := Builder{StripTags: map[uint64]bool{1000: true}}
+	b.AddArray(2, func(b *Builder) {
+		b.AddReencoded(hexDecode("d903e8a2616201616102"))
+		b.AddInt(1)
+	})
+	want := hexDecode("82a261610261620101")
+	if got, err := b.Bytes(); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got, want) {
+		t.Errorf("Bytes() = 0x%x, want 0x%x", got, want)
+	}
+}
+
+func TestAddReencodedError(t *testing.T) {
+	for _, data := range []string{
+		"",
+		"8201",
+		"0000",
+		"ff",
+		"9f01",
+		"62c328",
+		"bbffffffffffffffff",
+		"a20102",
+	} {
+		b := Builder{}
+		b.AddReencoded(hexDecode(data))
+		if got, err := b.Bytes(); err == nil {
+			t.Errorf("AddReencoded(0x%s) = 0x%x, want error", data, got)
+		}
+	}
+	b := Builder{MaxNestingDepth: 2}
+	b.AddReencoded(hexDecode("818181f6"))
+	if _, err := b.Bytes(); err == nil {
+		t.Error("AddReencoded() exceeded MaxNestingDepth")
+	}
+}
+
+func TestAddReencodedMaxNestingDepth(t *testing.T) {
+	const want = "cbor: exceeded max nesting depth"
+	for _, data := range []string{
+		"8281810102",
+		"9f8181819f01ffff",
+		"a101a1018101",
+	} {
+		b := Builder{MaxNestingDepth: 2}
+		b.AddReencoded(hexDecode(data))
+		if _, err := b.Bytes(); err == nil || err.Error() != want {
+			t.Errorf("AddReencoded(0x%s) returned error %v, want %s", data, err, want)
+		}
+	}
+}
+
+func TestAddReencodedModeFloat(t *testing.T) {
+	tests := []struct {
+		name string
+		mode ModeFloat
+		data string
+		want string
+	}{
+		{"float16 16", ModeFloat16, "f93e00", "f93e00"},
+		{"float16 none", ModeFloatNone, "f93e00", "f93e00"},
+		{"float16 32", ModeFloat32, "f93e00", "fa3fc00000"},
+		{"float32 16", ModeFloat16, "fa3fc00000", "f93e00"},
+		{"float32 none", ModeFloatNone, "fa3fc00000", "fa3fc00000"},
+		{"float32 32", ModeFloat32, "fa3fc00000", "fa3fc00000"},
+		{"float32 inexact 16", ModeFloat16, "fa3f800001", "fa3f800001"},
+		{"float64 16", ModeFloat16, "fb3ff8000000000000", "f93e00"},
+		{"float64 none", ModeFloatNone, "fb3ff8000000000000", "fb3ff8000000000000"},
+		{"float64 32", ModeFloat32, "fb3ff8000000000000", "fa3fc00000"},
+		{"float64 inexact 32", ModeFloat32, "fb3ff0000000000001", "fb3ff0000000000001"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := Builder{ModeFloat: tt.mode}
+			b.AddReencoded(hexDecode(tt.data))
+			if got, err := b.Bytes(); err != nil {
+				t.Errorf("AddReencoded(0x%s) returned error %v", tt.data, err)
+			} else if !bytes.Equal(got, hexDecode(tt.want)) {
+				t.Errorf("AddReencoded(0x%s) = 0x%x, want 0x%s", tt.data, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddReencodedMaxNestedLevels(t *testing.T) {
+	const want = "cbor: data item exceeds MaxNestedLevels (1024)"
+	for _, data := range [][]byte{
+		nested("81", 4000000, "00"),
+		nested("9f", 4000000, "00"),
+		nested("c1", 4000000, "00"),
+	} {
+		b := Builder{}
+		b.AddReencoded(data)
+		if _, err := b.Bytes(); err == nil || err.Error() != want {
+			t.Errorf("AddReencoded() returned error %v, want %s", err, want)
+		}
+	}
+	b := Builder{}
+	b.AddReencoded(nested("81", 1024, "00"))
+	if _, err := b.Bytes(); err != nil {
+		t.Errorf("AddReencoded() returned error %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package cbor
+
+import "reflect"
+
+// shareKey identifies a pointer. The type is part of the key because
+// a struct and its first field have the same address.
+type shareKey struct {
+	ptr uintptr
+	t   reflect.Type
+}
+
+// shareState holds the pointers shared under ModeSharePointers.
+type shareState struct {
+	// counts is the number of occurrences of each pointer
+	// in the value passed to the last top-level Marshal call.
+	counts map[shareKey]int
+	// index is the index of each pointer marked with tag 28.
+	index map[shareKey]uint64
+	next  uint64
+}
+
+// count counts the occurrences of the pointers reachable from v.
+// The pointed values of a pointer are only walked once, so cyclic
+// values are counted in finite time.
+func (s *shareState) count(v interface{}, useJSONTags bool) {
+	s.counts = make(map[shareKey]int)
+	s.walk(reflect.ValueOf(v), useJSONTags)
+}
+
+func (s *shareState) walk(v reflect.Value, useJSONTags bool) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return
+		}
+		key := shareKey{v.Pointer(), v.Type()}
+		s.counts[key]++
+		if s.counts[key] == 1 {
+			s.walk(v.Elem(), useJSONTags)
+		}
+	case reflect.Interface:
+		s.walk(v.Elem(), useJSONTags)
+	case reflect.Array, reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return
+		}
+		for i := 0; i < v.Len(); i++ {
+			s.walk(v.Index(i), useJSONTags)
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			s.walk(iter.Key(), useJSONTags)
+			s.walk(iter.Value(), useJSONTags)
+		}
+	case reflect.Struct:
+		fields := cachedFields(v.Type(), useJSONTags)
+		for i := range fields.list {
+			if fv, ok := fieldByIndex(v, fields.list[i].index); ok {
+				s.walk(fv, useJSONTags)
+			}
+		}
+	}
+}
+
+// addShared appends a reference to the non-nil pointer v if it has been
+// marked already and reports true. Otherwise it appends the tag marking v
+// as shared if it occurs more than once and reports false, in which case
+// the pointed value must be appended by the caller.
+func (b *Builder) addShared(v reflect.Value) bool {
+	s := &b.share
+	key := shareKey{v.Pointer(), v.Type()}
+	if i, ok := s.index[key]; ok {
+		b.AddTag(29)
+		b.AddUint64(i)
+		return true
+	}
+	if s.counts[key] < 2 || b.sortedItems > 0 {
+		return false
+	}
+	if s.index == nil {
+		s.index = make(map[shareKey]uint64)
+	}
+	s.index[key] = s.next
+	s.next++
+	b.AddTag(28)
+	return false
+}
@@ -0,0 +1,190 @@
+package cbor
+
+import (
+	"io"
+	"math"
+)
+
+// maxReadChunk bounds the buffer growth when reading a string, so that
+// a corrupt length can't make the Decoder allocate more than it reads.
+const maxReadChunk = 64 << 10
+
+// A Decoder reads and decodes successive CBOR data items from an input
+// stream, such as a CBOR sequence as defined in RFC 8742.
+//
+// The Decoder reads exactly the bytes of each data item, so after Decode
+// returns the underlying reader is positioned at the start of the next one.
+// As it may issue many small reads, wrap unbuffered readers in a bufio.Reader.
+type Decoder struct {
+	r      io.Reader
+	opts   DecodeOptions
+	limits decodeLimits
+	buf    []byte
+	offset int64
+}
+
+// NewDecoder returns a new Decoder that reads from r
+// with the default limits of DecodeOptions.
+func NewDecoder(r io.Reader) *Decoder {
+	return DecodeOptions{}.NewDecoder(r)
+}
+
+// NewDecoder returns a new Decoder that reads from r and enforces the
+// limits of o. Lengths exceeding them are reported before reading the
+// content of the data item.
+func (o DecodeOptions) NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: r, opts: o, limits: o.limits()}
+}
+
+// Decode reads the next data item from its input and stores it in the
+// value pointed to by v, following the rules of Unmarshal.
+// It returns io.EOF if the input has no more data items, and
+// io.ErrUnexpectedEOF if it ends in the middle of one.
+func (dec *Decoder) Decode(v interface{}) error {
+	dec.buf = dec.buf[:0]
+	if err := dec.read(1); err != nil {
+		return err
+	}
+	if err := dec.item(0, 0); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	dec.offset += int64(len(dec.buf))
+	return dec.opts.Unmarshal(dec.buf, v)
+}
+
+// InputOffset returns the number of bytes consumed by the data items
+// read so far, which is the offset of the next data item in the input.
+func (dec *Decoder) InputOffset() int64 {
+	return dec.offset
+}
+
+// read appends the next n bytes of the input to the buffer.
+func (dec *Decoder) read(n uint64) error {
+	for n > 0 {
+		chunk := n
+		if chunk > maxReadChunk {
+			chunk = maxReadChunk
+		}
+		start := len(dec.buf)
+		for uint64(cap(dec.buf)-start) < chunk {
+			dec.buf = append(dec.buf[:cap(dec.buf)], 0)
+		}
+		dec.buf = dec.buf[:start+int(chunk)]
+		if _, err := io.ReadFull(dec.r, dec.buf[start:]); err != nil {
+			dec.buf = dec.buf[:start]
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// item reads the rest of the data item whose first byte is in the buffer
+// at start. depth is the number of arrays, maps and tags enclosing it.
+// The limits are checked before reading the content they bound, including
+// the elements and chunks of indefinite-length items.
+func (dec *Decoder) item(start, depth int) error {
+	major, arg, err := dec.head(start)
+	if err != nil && err != errIndefinite {
+		return err
+	}
+	if major == cborTypeArray || major == cborTypeMap || major == cborTypeTag {
+		depth++
+		if err := dec.limits.nest(depth); err != nil {
+			return err
+		}
+	}
+	if err == errIndefinite {
+		if major == cborTypePrimitives || major == cborTypePositiveInt || major == cborTypeNegativeInt || major == cborTypeTag {
+			return errInvalidIndefinite
+		}
+		// n is the number of elements or pairs, or of string bytes.
+		var n uint64
+		for {
+			next := len(dec.buf)
+			if err := dec.read(1); err != nil {
+				return err
+			}
+			if dec.buf[next] == cborBreak {
+				return nil
+			}
+			if major == cborTypeByteString || major == cborTypeTextString {
+				if dec.buf[next]&0xe0 != major || dec.buf[next]&0x1f == 31 {
+					return errInvalidChunk
+				}
+				_, size, err := dec.head(next)
+				if err != nil {
+					return err
+				}
+				if n += size; n < size {
+					// Saturate so that the limit still applies.
+					n = math.MaxUint64
+				}
+				if err := dec.limits.check(major, n); err != nil {
+					return err
+				}
+				if err := dec.read(size); err != nil {
+					return err
+				}
+				continue
+			}
+			n++
+			if err := dec.limits.check(major, n); err != nil {
+				return err
+			}
+			if err := dec.item(next, depth); err != nil {
+				return err
+			}
+			if major == cborTypeMap {
+				if err := dec.next(depth); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if err := dec.limits.check(major, arg); err != nil {
+		return err
+	}
+	switch major {
+	case cborTypeByteString, cborTypeTextString:
+		return dec.read(arg)
+	case cborTypeArray, cborTypeMap:
+		for i := uint64(0); i < arg; i++ {
+			if err := dec.next(depth); err != nil {
+				return err
+			}
+			if major == cborTypeMap {
+				if err := dec.next(depth); err != nil {
+					return err
+				}
+			}
+		}
+	case cborTypeTag:
+		return dec.next(depth)
+	}
+	return nil
+}
+
+// head reads the rest of the head whose first byte is in the buffer
+// at start and returns its major type and argument.
+func (dec *Decoder) head(start int) (byte, uint64, error) {
+	if info := dec.buf[start] & 0x1f; info >= 24 && info <= 27 {
+		if err := dec.read(1 << (info - 24)); err != nil {
+			return 0, 0, err
+		}
+	}
+	major, arg, _, err := readHead(dec.buf[start:])
+	return major, arg, err
+}
+
+// next reads a whole data item enclosed in depth arrays, maps and tags.
+func (dec *Decoder) next(depth int) error {
+	start := len(dec.buf)
+	if err := dec.read(1); err != nil {
+		return err
+	}
+	return dec.item(start, depth)
+}
@@ -0,0 +1,123 @@
+package cbor
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecoder(t *testing.T) {
+	// 1, "IETF" and [_ 1, {"a": h'01'}], followed by the next payload.
+	r := bytes.NewReader(hexDecode("01" + "6449455446" + "9f01a1616141" + "01" + "ff" + "f5"))
+	dec := NewDecoder(r)
+	var (
+		i int
+		s string
+		a []interface{}
+	)
+	for _, tt := range []struct {
+		v          interface{}
+		want       interface{}
+		wantOffset int64
+	}{
+		{&i, 1, 1},
+		{&s, "IETF", 6},
+		{&a, []interface{}{uint64(1), map[interface{}]interface{}{"a": []byte{1}}}, 14},
+	} {
+		if err := dec.Decode(tt.v); err != nil {
+			t.Fatal(err)
+		}
+		if got := reflect.ValueOf(tt.v).Elem().Interface(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Decode() = %#v, want %#v", got, tt.want)
+		}
+		if got := dec.InputOffset(); got != tt.wantOffset {
+			t.Errorf("InputOffset() = %d, want %d", got, tt.wantOffset)
+		}
+	}
+	// The reader is left at the next item.
+	if rest, _ := io.ReadAll(r); !bytes.Equal(rest, []byte{0xf5}) {
+		t.Errorf("remaining input = 0x%x, want 0xf5", rest)
+	}
+	if err := dec.Decode(&i); err != io.EOF {
+		t.Errorf("Decode() at end returned error %v, want io.EOF", err)
+	}
+}
+
+func TestDecoderError(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		err  error
+	}{
+		{"truncated head", "1a0102", io.ErrUnexpectedEOF},
+		{"truncated string", "6449", io.ErrUnexpectedEOF},
+		{"truncated array", "8301", io.ErrUnexpectedEOF},
+		{"truncated indefinite", "9f01", io.ErrUnexpectedEOF},
+		{"unexpected break", "ff", errInvalidIndefinite},
+		{"reserved", "1c", errReservedInfo},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var v interface{}
+			if err := NewDecoder(bytes.NewReader(hexDecode(tt.data))).Decode(&v); err != tt.err {
+				t.Errorf("Decode() returned error %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestDecoderLongString(t *testing.T) {
+	want := strings.Repeat("x", 3*maxReadChunk+1)
+	b := Builder{}
+	b.AddString(want)
+	data, err := b.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s string
+	opts := DecodeOptions{MaxStringBytes: -1}
+	if err := opts.NewDecoder(bytes.NewReader(data)).Decode(&s); err != nil {
+		t.Fatal(err)
+	}
+	if s != want {
+		t.Errorf("Decode() returned a string of length %d, want %d", len(s), len(want))
+	}
+	// A length larger than the input fails without allocating it.
+	var v interface{}
+	if err := opts.NewDecoder(bytes.NewReader(hexDecode("7b00ffffffffffffff61"))).Decode(&v); err != io.ErrUnexpectedEOF {
+		t.Errorf("Decode() returned error %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestDecoderIndefiniteLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		opts DecodeOptions
+		data []byte
+		want string
+	}{
+		{"array", DecodeOptions{MaxArrayElements: 10}, append([]byte{0x9f}, nested("00", 5000000, "ff")...), "cbor: array exceeds MaxArrayElements (10)"},
+		{"map", DecodeOptions{MaxMapPairs: 2}, append([]byte{0xbf}, nested("0000", 5000000, "ff")...), "cbor: map exceeds MaxMapPairs (2)"},
+		{"chunks", DecodeOptions{MaxStringBytes: 4}, append([]byte{0x5f}, nested("4100", 5000000, "ff")...), "cbor: string exceeds MaxStringBytes (4)"},
+		{"long chunk", DecodeOptions{MaxStringBytes: 4}, append(hexDecode("7f6401020304"), nested("7a7fffffff", 1, "")...), "cbor: string exceeds MaxStringBytes (4)"},
+		{"invalid chunk", DecodeOptions{}, hexDecode("5f01ff"), "cbor: invalid chunk in indefinite-length string"},
+		{"deep arrays", DecodeOptions{}, nested("81", 4000000, "00"), "cbor: data item exceeds MaxNestedLevels (1024)"},
+		{"deep indefinite arrays", DecodeOptions{}, nested("9f", 4000000, "00"), "cbor: data item exceeds MaxNestedLevels (1024)"},
+		{"deep tags", DecodeOptions{MaxNestedLevels: 2}, hexDecode("c1c1c100"), "cbor: data item exceeds MaxNestedLevels (2)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bytes.NewReader(tt.data)
+			var v interface{}
+			if err := tt.opts.NewDecoder(r).Decode(&v); err == nil || err.Error() != tt.want {
+				t.Errorf("Decode() returned error %v, want %s", err, tt.want)
+			}
+			// The limits are checked before reading the rest of the input.
+			if read := len(tt.data) - r.Len(); read > 2048 {
+				t.Errorf("Decode() read %d bytes, want at most 2048", read)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package cbor
+
+import (
+	"math/big"
+	"reflect"
+)
+
+// A TagSet registers Go types whose values are always wrapped in a given
+// CBOR tag when encoded, so applications can tag their own types without
+// implementing MarshalingValue. The zero value is an empty set.
+type TagSet struct {
+	types    map[reflect.Type]uint64
+	decimals map[reflect.Type]DecimalFunc
+}
+
+// A DecimalFunc returns the exponent and the coefficient of a decimal
+// value v, which represents the exact value coefficient*10^exp.
+type DecimalFunc func(v interface{}) (exp int64, coefficient *big.Int)
+
+// Add registers that values of type t are wrapped in tag num.
+// Registering t again replaces its tag number.
+func (s *TagSet) Add(t reflect.Type, num uint64) {
+	if s.types == nil {
+		s.types = make(map[reflect.Type]uint64)
+	}
+	delete(s.decimals, t)
+	s.types[t] = num
+}
+
+// AddDecimal registers that values of type t are encoded as decimal
+// fractions (tag 4) with the exponent and coefficient returned by fn,
+// which lets applications encode third-party decimal types, such as
+// github.com/shopspring/decimal.Decimal, without this package depending
+// on them. Registering t again replaces its previous registration.
+func (s *TagSet) AddDecimal(t reflect.Type, fn DecimalFunc) {
+	if s.decimals == nil {
+		s.decimals = make(map[reflect.Type]DecimalFunc)
+	}
+	delete(s.types, t)
+	s.decimals[t] = fn
+}
+
+// tag returns the tag number registered for t, if any.
+func (s *TagSet) tag(t reflect.Type) (uint64, bool) {
+	if s == nil {
+		return 0, false
+	}
+	num, ok := s.types[t]
+	return num, ok
+}
+
+// decimal returns the DecimalFunc registered for t, if any.
+func (s *TagSet) decimal(t reflect.Type) (DecimalFunc, bool) {
+	if s == nil {
+		return nil, false
+	}
+	fn, ok := s.decimals[t]
+	return fn, ok
+}
+
+func (s *TagSet) empty() bool {
+	return s == nil || (len(s.types) == 0 && len(s.decimals) == 0)
+}
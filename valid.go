@@ -0,0 +1,26 @@
+package cbor
+
+import (
+	"errors"
+	"strconv"
+)
+
+// Valid reports whether data holds a single well-formed CBOR data item,
+// as defined in RFC 8949 section 5.1, without decoding it.
+// If it doesn't, the error describes the first problem found and the offset
+// in data where it was found, such as a truncated head, a reserved additional
+// information value, an unexpected break or data after the item.
+// Valid does not check that the item is valid, for example that text strings
+// are UTF-8 or that maps have no duplicate keys. Items nested more than
+// DefaultMaxNestedLevels deep are reported as an error.
+func Valid(data []byte) error {
+	d := decodeState{data: data, decodeLimits: decodeLimits{maxNestedLevels: DefaultMaxNestedLevels}}
+	err := d.skip()
+	if err == nil && d.off != len(data) {
+		err = errExtraneousData
+	}
+	if err != nil {
+		return errors.New(err.Error() + " at offset " + strconv.Itoa(d.off))
+	}
+	return nil
+}
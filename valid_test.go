@@ -0,0 +1,62 @@
+package cbor
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValid(t *testing.T) {
+	for _, tc := range append(marshalTests, exMarshalTests...) {
+		if err := Valid(tc.cborData); err != nil {
+			t.Errorf("Valid(0x%x) returned error %v", tc.cborData, err)
+		}
+	}
+	for _, data := range []string{
+		"5f42010243030405ff",
+		"7f657374726561646d696e67ff",
+		"9f018202039f0405ffff",
+		"bf61610161629f0203ffff",
+		"826161bf61626163ff",
+		"f820",
+		"62c328", // well-formed but not valid UTF-8
+	} {
+		if err := Valid(hexDecode(data)); err != nil {
+			t.Errorf("Valid(0x%s) returned error %v", data, err)
+		}
+	}
+}
+
+func TestValidError(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"empty", "", "cbor: unexpected end of data at offset 0"},
+		{"truncated head", "1a0102", "cbor: unexpected end of data at offset 0"},
+		{"truncated string", "830162", "cbor: unexpected end of data at offset 3"},
+		{"truncated array", "830102", "cbor: unexpected end of data at offset 3"},
+		{"reserved 28", "1c", "cbor: reserved additional information at offset 0"},
+		{"reserved 30 nested", "a1611e", "cbor: unexpected end of data at offset 3"},
+		{"reserved 29 nested", "a1613d1d", "cbor: reserved additional information at offset 3"},
+		{"unexpected break", "8201ff", "cbor: unexpected break or indefinite length at offset 2"},
+		{"indefinite integer", "1f", "cbor: unexpected break or indefinite length at offset 0"},
+		{"indefinite tag", "df00", "cbor: unexpected break or indefinite length at offset 0"},
+		{"missing break", "9f0102", "cbor: unexpected end of data at offset 3"},
+		{"nested chunk", "5f5f4100ffff", "cbor: invalid chunk in indefinite-length string at offset 1"},
+		{"wrong chunk type", "7f4100ff", "cbor: invalid chunk in indefinite-length string at offset 1"},
+		{"two-byte simple", "f818", "cbor: invalid two-byte simple value at offset 0"},
+		{"extraneous data", "0001", "cbor: extraneous data at offset 1"},
+		{"missing tag content", "c1", "cbor: unexpected end of data at offset 1"},
+		{"too deep", strings.Repeat("81", 20000000) + "00", "cbor: data item exceeds MaxNestedLevels (1024) at offset 1025"},
+		{"too deep tags", strings.Repeat("c1", 1025) + "00", "cbor: data item exceeds MaxNestedLevels (1024) at offset 1025"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Valid(hexDecode(tt.data))
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("Valid(0x%s) returned error %v, want %s", tt.data, err, tt.want)
+			}
+		})
+	}
+}